@@ -2,57 +2,823 @@ package main
 
 import (
   "github.com/arstevens/goback/daemon/processor"
+  "encoding/json"
+  "text/tabwriter"
+  "path/filepath"
   "strconv"
-  "strings"
   "bufio"
+  "strings"
+  "time"
   "flag"
+  "fmt"
   "net"
-  "log"
   "os"
 )
 
 var GobackPort int = 25000
+var GobackSocket string = "/run/goback.sock"
+
+// How often progress is redrawn while following a backup
+var RefreshInterval time.Duration = 500 * time.Millisecond
+
+// Exit codes for each class of failure so scripts can react to them
+const (
+  ExitFailure int = 1
+  ExitBadArguments = 2
+  ExitUnknownRoot = 3
+  ExitNotMounted = 4
+  ExitCopyFailed = 5
+  ExitDaemonUnreachable = 6
+  ExitPermissionDenied = 7
+  ExitCanceled = 8
+)
+
+var exitCodes = map[processor.ErrorCode]int{
+  processor.InvalidRequestError: ExitBadArguments,
+  processor.UnknownCommandError: ExitBadArguments,
+  processor.UnknownRootError: ExitUnknownRoot,
+  processor.NotMountedError: ExitNotMounted,
+  processor.CopyFailedError: ExitCopyFailed,
+  processor.DaemonUnreachableError: ExitDaemonUnreachable,
+  processor.PermissionDeniedError: ExitPermissionDenied,
+  processor.CanceledError: ExitCanceled,
+}
 
 func main() {
+  if len(os.Args) > 1 {
+    switch os.Args[1] {
+      case "restore":
+        restoreMain(os.Args[2:])
+      case "history":
+        historyMain(os.Args[2:])
+      case "now":
+        nowMain(os.Args[2:])
+      case "list":
+        listMain(os.Args[2:], processor.ListCommand)
+      case "status":
+        listMain(os.Args[2:], processor.StatusCommand)
+      case "jobs":
+        jobsMain(os.Args[2:])
+      case "cancel":
+        cancelMain(os.Args[2:])
+      case "pause":
+        pauseMain(os.Args[2:], processor.PauseCommand)
+      case "resume":
+        pauseMain(os.Args[2:], processor.ResumeCommand)
+      case "events":
+        eventsMain(os.Args[2:])
+    }
+  }
+
   originalDir := flag.String("o", "", "Directory to backup")
   reflectDir := flag.String("c", "", "Location to backup to")
   remove := flag.Bool("r", false, "Stop backing up provided directory")
+  wait := flag.Bool("wait", false, "Wait for the first backup of a new directory to finish")
+  refCode := flag.String("t", "pref", "Reflector type to backup with (pref, iref, sref, snap)")
+
+  retain := flag.Bool("retain", false, "Replace the retention policy of the provided directory")
+  prune := flag.Bool("prune", false, "Prune old snapshots of the provided directory now")
+  dryRun := flag.Bool("dry-run", false, "With -prune only list the snapshots that would be pruned")
+  keepLast := flag.Int("keep-last", 0, "Keep the newest N snapshots")
+  hourly := flag.Int("hourly", 0, "Keep one snapshot for each of the last N hours")
+  daily := flag.Int("daily", 0, "Keep one snapshot for each of the last N days")
+  weekly := flag.Int("weekly", 0, "Keep one snapshot for each of the last N weeks")
+  monthly := flag.Int("monthly", 0, "Keep one snapshot for each of the last N months")
+  maxSize := flag.String("max-size", "0", "Prune the oldest snapshots beyond this size (e.g. 500M, 20G)")
+
+  settle := flag.Bool("settle", false, "Replace the settle window of the provided directory")
+  quiet := flag.Duration("quiet", 0, "Back up changes once the directory was quiet this long (default 2s)")
+  maxDelay := flag.Duration("max-delay", 0, "Back up changes at the latest this long after the first one (default 30s)")
+
+  redetect := flag.Bool("redetect", false, "Replace the change detection of the provided directory")
+  detect := flag.String("detect", "auto", "How changes are detected (auto, poll)")
 
   flag.Parse()
-  var resp string
+  // The daemon only lets users other than root name absolute paths
+  *originalDir, *reflectDir = absPath(*originalDir), absPath(*reflectDir)
+  size, err := parseSize(*maxSize)
+  if err != nil {
+    badArguments("Invalid -max-size %s: %v", *maxSize, err)
+  }
+  policy := processor.RetentionPolicy{
+    KeepLast: *keepLast,
+    Hourly: *hourly,
+    Daily: *daily,
+    Weekly: *weekly,
+    Monthly: *monthly,
+    MaxSize: size,
+  }
+  settlePolicy := processor.SettlePolicy{Quiet: *quiet, MaxDelay: *maxDelay}
+
   if *remove {
-    rmCmd := processor.UnbackupCommand+":"+*originalDir
-    resp = executeCommand(rmCmd)
-  } else {
-    bkCmd := processor.NewBackupCommand+":"+*originalDir+","+*reflectDir+","+"pref"
-    resp = executeCommand(bkCmd)
+    finish(executeCommand(processor.UnbackupCommand, processor.RootArgs{Root: *originalDir}))
+  } else if *retain {
+    args := processor.RetentionArgs{Root: *originalDir, Retention: policy}
+    finish(executeCommand(processor.RetentionCommand, args))
+  } else if *redetect {
+    args := processor.DetectionArgs{Root: *originalDir, Detection: processor.DetectionMode(*detect)}
+    finish(executeCommand(processor.DetectionCommand, args))
+  } else if *settle {
+    args := processor.SettleArgs{Root: *originalDir, Settle: settlePolicy}
+    finish(executeCommand(processor.SettleCommand, args))
+  } else if *prune {
+    var pruned []string
+    args := processor.PruneArgs{Root: *originalDir, DryRun: *dryRun}
+    decodeResponse(executeCommand(processor.PruneCommand, args), &pruned)
+    if len(pruned) > 0 {
+      if *dryRun {
+        fmt.Println("Would prune:")
+      } else {
+        fmt.Println("Pruned:")
+      }
+      fmt.Println(strings.Join(pruned, "\n"))
+    }
+    os.Exit(0)
   }
 
-  if resp == processor.SuccessCode {
+  args := processor.NewBackupArgs{
+    Original: *originalDir,
+    Reflection: *reflectDir,
+    Reflector: processor.ReflectorCode(*refCode),
+    Retention: policy,
+    Settle: settlePolicy,
+    Detection: processor.DetectionMode(*detect),
+  }
+  var job processor.Job
+  decodeResponse(executeCommand(processor.NewBackupCommand, args), &job)
+  if !*wait {
+    fmt.Printf("First backup of %s queued as job %s\n", job.Root, job.ID)
     os.Exit(0)
   }
-  os.Exit(1)
+  if isTerminal(os.Stderr) {
+    job = followJob(job.ID)
+  } else {
+    job = waitForJob(job.ID)
+  }
+  printJobResult(job)
+  os.Exit(jobsExitCode([]processor.Job{job}))
 }
 
-func executeCommand(cmd string) string {
-  cmd += "\n"
-  conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(GobackPort))
-  if err != nil {
-    log.Printf("Failed to connect to daemon on port %d", GobackPort)
+// absPath() is filepath.Abs() that leaves empty and unresolvable paths alone
+func absPath(path string) string {
+  if path == "" {
     return ""
   }
-  defer conn.Close()
+  if abs, err := filepath.Abs(path); err == nil {
+    return abs
+  }
+  return path
+}
+
+/* restoreMain() handles "goback restore" which copies a backup
+back to its original directory or somewhere else */
+func restoreMain(args []string) {
+  restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
+  originalDir := restoreFlags.String("o", "", "Backed up directory to restore")
+  target := restoreFlags.String("to", "", "Restore into this directory instead of the original")
+  path := restoreFlags.String("p", "", "Only restore this file or directory")
+  snapshot := restoreFlags.String("snapshot", "", "Snapshot to restore (defaults to the latest)")
+  at := restoreFlags.String("at", "", "Restore the newest snapshot taken at or before this time (e.g. \"2026-10-18 09:00\")")
+  conflict := restoreFlags.String("conflict", string(processor.KeepBothConflicts),
+    "What to do with files that already exist (overwrite, skip, keep-both)")
+  dryRun := restoreFlags.Bool("dry-run", false, "Only list what would be restored")
+  restoreFlags.Parse(args)
+
+  if *path != "" && !filepath.IsAbs(*path) && *originalDir == "" {
+    abs, err := filepath.Abs(*path)
+    if err != nil {
+      badArguments("Couldn't resolve %s: %v", *path, err)
+    }
+    *path = abs
+  }
+  rstArgs := processor.RestoreArgs{
+    Root: absPath(*originalDir),
+    Target: absPath(*target),
+    Path: *path,
+    Snapshot: *snapshot,
+    Policy: processor.ConflictPolicy(*conflict),
+    DryRun: *dryRun,
+  }
+  if *at != "" {
+    parsed, err := parseTime(*at)
+    if err != nil {
+      badArguments("Invalid -at %s: %v", *at, err)
+    }
+    rstArgs.At = parsed
+  }
 
-  if _, err = conn.Write([]byte(cmd)); err != nil {
-    log.Printf("Failed to write to daemon on port %d", GobackPort)
-    return ""
+  var actions []string
+  decodeResponse(executeCommand(processor.RestoreCommand, rstArgs), &actions)
+  if len(actions) > 0 {
+    fmt.Println(strings.Join(actions, "\n"))
+  }
+  os.Exit(0)
+}
+
+/* historyMain() handles "goback history [path]" which lists
+previous backup runs of one or every backed up directory */
+func historyMain(args []string) {
+  historyFlags := flag.NewFlagSet("history", flag.ExitOnError)
+  asJSON := historyFlags.Bool("json", false, "Print the history as JSON")
+  historyFlags.Parse(args)
+
+  root := historyFlags.Arg(0)
+  if root != "" {
+    if abs, err := filepath.Abs(root); err == nil {
+      root = abs
+    }
+  }
+
+  resp := executeCommand(processor.HistoryCommand, processor.RootArgs{Root: root})
+  if *asJSON {
+    printResult(resp)
+  }
+
+  var runs []processor.RunRecord
+  decodeResponse(resp, &runs)
+  table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintln(table, "STARTED\tDURATION\tTRIGGER\tFILES\tBYTES\tRESULT\tDIRECTORY")
+  for _, run := range runs {
+    result := "ok"
+    if run.Error != "" {
+      result = run.Error
+    }
+    fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", run.Start.Format("2006-01-02 15:04:05"),
+      run.End.Sub(run.Start).Round(time.Second), run.Trigger, run.FilesCopied,
+      formatSize(run.BytesCopied), result, run.OriginalRoot)
+  }
+  table.Flush()
+  os.Exit(0)
+}
+
+/* nowMain() handles "goback now [path]" which backs up one or
+every directory immediately and waits for the result. A progress
+bar is drawn while waiting when stderr is a terminal */
+func nowMain(args []string) {
+  nowFlags := flag.NewFlagSet("now", flag.ExitOnError)
+  asJSON := nowFlags.Bool("json", false, "Print the jobs as JSON")
+  detach := nowFlags.Bool("detach", false, "Print the queued jobs without waiting for them")
+  nowFlags.Parse(args)
+
+  root := nowFlags.Arg(0)
+  if root != "" {
+    if abs, err := filepath.Abs(root); err == nil {
+      root = abs
+    }
+  }
+
+  bakArgs := processor.BackupArgs{Root: root, Trigger: processor.ManualTrigger, Force: true}
+  var jobs []processor.Job
+  decodeResponse(executeCommand(processor.BackupCommand, bakArgs), &jobs)
+  if *detach {
+    if *asJSON {
+      printJSON(jobs)
+    } else {
+      for _, job := range jobs {
+        fmt.Printf("%s: queued as job %s\n", job.Root, job.ID)
+      }
+    }
+    os.Exit(0)
+  }
+
+  for i, job := range jobs {
+    if !*asJSON && isTerminal(os.Stderr) {
+      jobs[i] = followJob(job.ID)
+    } else {
+      jobs[i] = waitForJob(job.ID)
+    }
+    if !*asJSON {
+      printJobResult(jobs[i])
+    }
+  }
+  if *asJSON {
+    printJSON(jobs)
+  }
+  os.Exit(jobsExitCode(jobs))
+}
+
+/* jobsMain() handles "goback jobs [id]" which lists queued, running
+and recently finished backups or shows and optionally waits for one */
+func jobsMain(args []string) {
+  jobsFlags := flag.NewFlagSet("jobs", flag.ExitOnError)
+  asJSON := jobsFlags.Bool("json", false, "Print the jobs as JSON")
+  wait := jobsFlags.Bool("wait", false, "Wait for the job to finish")
+  jobsFlags.Parse(args)
+
+  id := jobsFlags.Arg(0)
+  if *wait && id == "" {
+    badArguments("-wait needs a job id")
+  }
+
+  var jobs []processor.Job
+  decodeResponse(executeCommand(processor.JobCommand, processor.JobArgs{ID: id, Wait: *wait}), &jobs)
+  if *asJSON {
+    printJSON(jobs)
+  } else if *wait {
+    printJobResult(jobs[0])
+  } else {
+    printJobs(jobs)
+  }
+  if *wait {
+    os.Exit(jobsExitCode(jobs))
+  }
+  os.Exit(0)
+}
+
+/* cancelMain() handles "goback cancel [path]" which stops the
+queued and running backups of a directory, or of every directory
+when none is given, and "goback cancel -job id" */
+func cancelMain(args []string) {
+  cancelFlags := flag.NewFlagSet("cancel", flag.ExitOnError)
+  id := cancelFlags.String("job", "", "Only cancel the job with this id")
+  cancelFlags.Parse(args)
+
+  root := cancelFlags.Arg(0)
+  if root != "" {
+    if abs, err := filepath.Abs(root); err == nil {
+      root = abs
+    }
+  }
+
+  var jobs []processor.Job
+  cnlArgs := processor.CancelArgs{ID: *id, Root: root}
+  decodeResponse(executeCommand(processor.CancelCommand, cnlArgs), &jobs)
+  if len(jobs) == 0 {
+    fmt.Println("Nothing to cancel")
+  }
+  for _, job := range jobs {
+    fmt.Printf("%s: job %s %s\n", job.Root, job.ID, job.State)
+  }
+  os.Exit(0)
+}
+
+/* pauseMain() handles "goback pause [path]" which stops changes
+and drives being mounted from starting backups of a directory, or
+of every directory when none is given, and "goback resume [path]"
+which catches up on whatever changed in the meantime */
+func pauseMain(args []string, command processor.CommandCode) {
+  pauseFlags := flag.NewFlagSet(string(command), flag.ExitOnError)
+  pauseFlags.Parse(args)
+
+  root := pauseFlags.Arg(0)
+  if root != "" {
+    if abs, err := filepath.Abs(root); err == nil {
+      root = abs
+    }
+  }
+
+  resp := executeCommand(command, processor.RootArgs{Root: root})
+  if command == processor.PauseCommand {
+    finish(resp)
+  }
+
+  var jobs []processor.Job
+  decodeResponse(resp, &jobs)
+  for _, job := range jobs {
+    fmt.Printf("%s: catching up as job %s\n", job.Root, job.ID)
+  }
+  os.Exit(0)
+}
+
+/* eventsMain() handles "goback events" which prints everything the
+daemon reports as a line of JSON per event until interrupted */
+func eventsMain(args []string) {
+  eventsFlags := flag.NewFlagSet("events", flag.ExitOnError)
+  eventsFlags.Parse(args)
+
+  _, reader, resp := openCommand(processor.SubscribeCommand, nil)
+  if resp.Error != nil {
+    finish(resp)
+  }
+
+  for {
+    line, err := reader.ReadString('\n')
+    fmt.Print(line)
+    if err != nil {
+      finish(failedResponse(processor.DaemonUnreachableError, fmt.Sprintf("Lost connection to daemon: %v", err)))
+    }
+  }
+}
+
+func printJobs(jobs []processor.Job) {
+  table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintln(table, "ID\tKIND\tSTATE\tTRIGGER\tQUEUED\tDIRECTORY\tRESULT")
+  for _, job := range jobs {
+    result := ""
+    if job.Error != nil {
+      result = job.Error.Message
+    } else if job.Run != nil {
+      result = fmt.Sprintf("%d files (%s)", job.Run.FilesCopied, formatSize(job.Run.BytesCopied))
+    } else if job.State == processor.JobDone && job.Kind == processor.RestoreJob {
+      result = "restored"
+    } else if job.State == processor.JobDone && job.Kind == processor.PruneJob {
+      result = "pruned"
+    } else if job.State == processor.JobDone {
+      result = "nothing to do"
+    }
+    fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.Kind, job.State, job.Trigger,
+      job.Queued.Format("2006-01-02 15:04:05"), job.Root, result)
+  }
+  table.Flush()
+}
+
+func printJobResult(job processor.Job) {
+  if job.Error != nil {
+    fmt.Printf("%s: failed: %s\n", job.Root, job.Error.Message)
+  } else if job.Run != nil {
+    run := job.Run
+    fmt.Printf("%s: backed up %d files (%s) in %s\n", run.OriginalRoot, run.FilesCopied,
+      formatSize(run.BytesCopied), run.End.Sub(run.Start).Round(time.Millisecond))
+  } else {
+    fmt.Printf("%s: nothing to back up\n", job.Root)
+  }
+}
+
+// waitForJob() blocks until the daemon reports job id as finished
+func waitForJob(id string) processor.Job {
+  var jobs []processor.Job
+  decodeResponse(executeCommand(processor.JobCommand, processor.JobArgs{ID: id, Wait: true}), &jobs)
+  if len(jobs) != 1 {
+    finish(failedResponse(processor.CommandFailedError, "Daemon didn't return job "+id))
+  }
+  return jobs[0]
+}
+
+/* followJob() is waitForJob() but polls the job instead so its
+progress can be drawn on stderr in the meantime */
+func followJob(id string) processor.Job {
+  for {
+    var jobs []processor.Job
+    decodeResponse(executeCommand(processor.JobCommand, processor.JobArgs{ID: id}), &jobs)
+    if len(jobs) != 1 {
+      finish(failedResponse(processor.CommandFailedError, "Daemon didn't return job "+id))
+    }
+    job := jobs[0]
+    if job.State != processor.JobQueued && job.State != processor.JobRunning {
+      fmt.Fprint(os.Stderr, "\r\033[K")
+      return job
+    }
+    fmt.Fprintf(os.Stderr, "\r\033[K%s", progressLine(job))
+    time.Sleep(RefreshInterval)
+  }
+}
+
+/* progressLine() describes how far a job has come in a single line.
+Once the size of the backup is known it includes a progress bar */
+func progressLine(job processor.Job) string {
+  p := job.Progress
+  if job.State == processor.JobQueued {
+    return fmt.Sprintf("Job %s is queued", job.ID)
+  } else if p == nil {
+    return fmt.Sprintf("Job %s is starting", job.ID)
+  } else if p.Phase == processor.ScanningPhase {
+    return fmt.Sprintf("Scanning: %d files (%s)", p.FilesScanned, formatSize(p.BytesTotal))
+  }
+
+  fraction := 1.0
+  if p.BytesTotal > 0 {
+    fraction = float64(p.BytesDone) / float64(p.BytesTotal)
+  }
+  width := 30
+  filled := int(fraction * float64(width))
+  line := fmt.Sprintf("[%s%s] %3.0f%% %s/%s, %d copied", strings.Repeat("=", filled),
+    strings.Repeat(" ", width - filled), fraction * 100, formatSize(p.BytesDone),
+    formatSize(p.BytesTotal), p.FilesCopied)
+  if p.ETA > 0 {
+    line += ", "+p.ETA.String()+" left"
   }
+  if p.CurrentFile != "" {
+    line += " "+filepath.Base(p.CurrentFile)
+  }
+  return line
+}
+
+func isTerminal(f *os.File) bool {
+  fi, err := f.Stat()
+  return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// jobsExitCode() is the exit code of the first failed job
+func jobsExitCode(jobs []processor.Job) int {
+  for _, job := range jobs {
+    if job.Error == nil {
+      continue
+    }
+    if code, ok := exitCodes[job.Error.Code]; ok {
+      return code
+    }
+    return ExitFailure
+  }
+  return 0
+}
+
+/* listMain() handles "goback list" which shows every backup as a
+table and "goback status [path]" which describes backups in detail.
+"goback status -watch" keeps redrawing the status until interrupted */
+func listMain(args []string, command processor.CommandCode) {
+  listFlags := flag.NewFlagSet(string(command), flag.ExitOnError)
+  asJSON := listFlags.Bool("json", false, "Print the backups as JSON")
+  watch := false
+  if command == processor.StatusCommand {
+    listFlags.BoolVar(&watch, "watch", false, "Keep redrawing the status with the progress of running backups")
+  }
+  listFlags.Parse(args)
+  if watch && *asJSON {
+    badArguments("-watch can't be combined with -json")
+  }
+
+  root := listFlags.Arg(0)
+  if root != "" {
+    if abs, err := filepath.Abs(root); err == nil {
+      root = abs
+    }
+  }
+
+  if watch {
+    watchStatus(root)
+  }
+
+  resp := executeCommand(command, processor.RootArgs{Root: root})
+  if *asJSON {
+    printResult(resp)
+  }
+
+  var statuses []processor.BackupStatus
+  decodeResponse(resp, &statuses)
+  if command == processor.ListCommand {
+    printList(statuses)
+  } else {
+    printStatus(statuses)
+  }
+  os.Exit(0)
+}
+
+// watchStatus() clears the screen and prints the status over and over
+func watchStatus(root string) {
+  for {
+    var statuses []processor.BackupStatus
+    decodeResponse(executeCommand(processor.StatusCommand, processor.RootArgs{Root: root}), &statuses)
+    fmt.Print("\033[H\033[2J")
+    fmt.Println(time.Now().Format("2006-01-02 15:04:05"))
+    fmt.Println()
+    printStatus(statuses)
+    time.Sleep(RefreshInterval)
+  }
+}
+
+func printList(statuses []processor.BackupStatus) {
+  table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintln(table, "DIRECTORY\tDRIVE\tLOCATION\tMOUNTED\tPENDING\tPAUSED\tLAST BACKUP")
+  for _, status := range statuses {
+    fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", status.OriginalRoot, status.DriveLabel,
+      status.ReflectionBase, yesNo(status.Mounted), yesNo(status.HasChanged), yesNo(status.Paused),
+      lastSuccess(status))
+  }
+  table.Flush()
+}
+
+func printStatus(statuses []processor.BackupStatus) {
+  for i, status := range statuses {
+    if i > 0 {
+      fmt.Println()
+    }
+    table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintf(table, "Directory:\t%s\n", status.OriginalRoot)
+    fmt.Fprintf(table, "Reflector:\t%s\n", status.ReflectionCode)
+    fmt.Fprintf(table, "Drive:\t%s\n", status.DriveLabel)
+    fmt.Fprintf(table, "Location on drive:\t%s\n", status.ReflectionBase)
+    if status.Mounted {
+      fmt.Fprintf(table, "Mounted:\tyes at %s\n", status.ReflectionRoot)
+    } else {
+      fmt.Fprintf(table, "Mounted:\tno\n")
+    }
+    fmt.Fprintf(table, "Changes pending:\t%s\n", yesNo(status.HasChanged))
+    fmt.Fprintf(table, "Automatic backups paused:\t%s\n", yesNo(status.Paused))
+    if status.Job != nil {
+      fmt.Fprintf(table, "Backup in progress:\t%s\n", progressLine(*status.Job))
+      if p := status.Job.Progress; p != nil && p.CurrentFile != "" {
+        fmt.Fprintf(table, "Current file:\t%s\n", p.CurrentFile)
+      }
+    }
+    fmt.Fprintf(table, "Last successful backup:\t%s\n", lastSuccess(status))
+    if status.LastRun != nil && status.LastRun.Error != "" {
+      fmt.Fprintf(table, "Last run failed:\t%s\n", status.LastRun.Error)
+    }
+    if !status.Retention.IsZero() {
+      fmt.Fprintf(table, "Retention:\t%+v\n", status.Retention)
+    }
+    if status.Detection == processor.PollDetection {
+      fmt.Fprintf(table, "Change detection:\tpolling\n")
+    }
+    if !status.Settle.IsZero() {
+      fmt.Fprintf(table, "Settle window:\t%s\n", settleLine(status.Settle))
+    }
+    table.Flush()
+  }
+}
+
+// settleLine() describes a settle policy leaving out the daemon's defaults
+func settleLine(settle processor.SettlePolicy) string {
+  parts := make([]string, 0, 2)
+  if settle.Quiet != 0 {
+    parts = append(parts, "quiet for "+settle.Quiet.String())
+  }
+  if settle.MaxDelay != 0 {
+    parts = append(parts, "at most "+settle.MaxDelay.String())
+  }
+  return strings.Join(parts, ", ")
+}
+
+func lastSuccess(status processor.BackupStatus) string {
+  if status.LastSuccess == nil {
+    return "never"
+  }
+  return status.LastSuccess.Format("2006-01-02 15:04:05")
+}
+
+func yesNo(value bool) string {
+  if value {
+    return "yes"
+  }
+  return "no"
+}
+
+/* finish() exits with the outcome of a command that has no output.
+Failures print the reason and exit with the code for their class */
+func finish(resp processor.Response) {
+  if resp.Error != nil {
+    fmt.Fprintf(os.Stderr, "goback: %s\n", resp.Error.Message)
+  }
+  os.Exit(exitCode(resp))
+}
+
+// exitCode() is the exit code documented for the error of resp
+func exitCode(resp processor.Response) int {
+  if resp.Error == nil {
+    return 0
+  }
+  if code, ok := exitCodes[resp.Error.Code]; ok {
+    return code
+  }
+  return ExitFailure
+}
+
+func badArguments(format string, a ...interface{}) {
+  finish(failedResponse(processor.InvalidRequestError, fmt.Sprintf(format, a...)))
+}
 
-  resp, err := bufio.NewReader(conn).ReadString('\n')
+// printResult() prints the raw JSON result of a command and exits
+func printResult(resp processor.Response) {
+  if resp.Error == nil && len(resp.Result) > 0 {
+    fmt.Println(string(resp.Result))
+  }
+  finish(resp)
+}
+
+func printJSON(v interface{}) {
+  serial, err := json.Marshal(v)
   if err != nil {
-    log.Printf("Failed to read from daemon on port %d", GobackPort)
-    return ""
+    finish(failedResponse(processor.CommandFailedError, err.Error()))
+  }
+  fmt.Println(string(serial))
+}
+
+/* decodeResponse() decodes the result of a command into result
+and exits if the command failed */
+func decodeResponse(resp processor.Response, result interface{}) {
+  if resp.Error != nil {
+    finish(resp)
+  }
+  if err := resp.DecodeResult(result); err != nil {
+    finish(failedResponse(processor.CommandFailedError, fmt.Sprintf("Failed to parse response from daemon: %v", err)))
+  }
+}
+
+/* executeCommand() sends a single request to the daemon and returns
+its response. Failing to reach the daemon is reported as a failed
+response */
+func executeCommand(cmd processor.CommandCode, args interface{}) processor.Response {
+  conn, _, resp := openCommand(cmd, args)
+  if conn != nil {
+    conn.Close()
   }
-  resp = strings.Trim(resp, "\n")
   return resp
 }
+
+/* openCommand() sends a request to the daemon and reads the first
+line of its response. When the command succeeds the connection is
+left open so the rest of a streamed response can be read from the
+returned reader */
+func openCommand(cmd processor.CommandCode, args interface{}) (net.Conn, *bufio.Reader, processor.Response) {
+  id := strconv.Itoa(os.Getpid())+"-"+strconv.FormatInt(time.Now().UnixNano(), 36)
+  req, err := processor.NewRequest(id, cmd, args)
+  if err != nil {
+    return nil, nil, failedResponse(processor.InvalidRequestError, err.Error())
+  }
+  serial, err := json.Marshal(req)
+  if err != nil {
+    return nil, nil, failedResponse(processor.InvalidRequestError, fmt.Sprintf("Failed to encode request: %v", err))
+  }
+
+  conn, addr, err := dialDaemon()
+  if err != nil {
+    return nil, nil, failedResponse(processor.DaemonUnreachableError,
+      fmt.Sprintf("Failed to connect to daemon on %s: %v", addr, err))
+  }
+  fail := func(code processor.ErrorCode, message string) (net.Conn, *bufio.Reader, processor.Response) {
+    conn.Close()
+    return nil, nil, failedResponse(code, message)
+  }
+
+  if _, err = conn.Write(append(serial, '\n')); err != nil {
+    return fail(processor.DaemonUnreachableError, fmt.Sprintf("Failed to write to daemon on %s: %v", addr, err))
+  }
+
+  reader := bufio.NewReader(conn)
+  line, err := reader.ReadBytes('\n')
+  if err != nil && len(line) == 0 {
+    return fail(processor.DaemonUnreachableError, fmt.Sprintf("Failed to read from daemon on %s: %v", addr, err))
+  }
+  var resp processor.Response
+  if err = json.Unmarshal(line, &resp); err != nil {
+    return fail(processor.CommandFailedError, fmt.Sprintf("Invalid response from daemon: %v", err))
+  }
+  if resp.ID != req.ID {
+    return fail(processor.CommandFailedError, fmt.Sprintf("Response %s doesn't match request %s", resp.ID, req.ID))
+  }
+  if resp.Status != processor.SuccessCode && resp.Error == nil {
+    resp.Error = &processor.Error{Code: processor.CommandFailedError, Message: "Command failed"}
+  }
+  return conn, reader, resp
+}
+
+/* dialDaemon() connects to the Unix socket of the daemon, which can
+be moved with GOBACK_SOCKET. Daemons started with -tcp and no socket
+are reached on localhost instead */
+func dialDaemon() (net.Conn, string, error) {
+  socket := GobackSocket
+  if env := os.Getenv("GOBACK_SOCKET"); env != "" {
+    socket = env
+  }
+  if _, err := os.Stat(socket); err == nil {
+    conn, err := net.Dial("unix", socket)
+    return conn, socket, err
+  }
+
+  addr := "localhost:"+strconv.Itoa(GobackPort)
+  conn, err := net.Dial("tcp", addr)
+  return conn, addr, err
+}
+
+func failedResponse(code processor.ErrorCode, message string) processor.Response {
+  return processor.Response{
+    Version: processor.ProtocolVersion,
+    Status: processor.FailCode,
+    Error: &processor.Error{Code: code, Message: message},
+  }
+}
+
+// parseTime() reads a local time in any of a few common layouts
+func parseTime(value string) (time.Time, error) {
+  layouts := []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05",
+    "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+  for _, layout := range layouts {
+    if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+      return parsed, nil
+    }
+  }
+  return time.Time{}, fmt.Errorf("unknown time format")
+}
+
+func formatSize(size int64) string {
+  units := []string{"B", "K", "M", "G", "T"}
+  value := float64(size)
+  unit := 0
+  for value >= 1024 && unit < len(units) - 1 {
+    value /= 1024
+    unit++
+  }
+  if unit == 0 {
+    return strconv.FormatInt(size, 10)+units[0]
+  }
+  return strconv.FormatFloat(value, 'f', 1, 64)+units[unit]
+}
+
+// parseSize() reads a byte count with an optional K, M, G or T suffix
+func parseSize(size string) (int64, error) {
+  size = strings.ToUpper(strings.TrimSpace(size))
+  multiplier := int64(1)
+  for i, suffix := range []string{"K", "M", "G", "T"} {
+    if strings.HasSuffix(size, suffix) {
+      multiplier = int64(1) << (10 * uint(i + 1))
+      size = strings.TrimSuffix(size, suffix)
+      break
+    }
+  }
+
+  n, err := strconv.ParseInt(size, 10, 64)
+  if err != nil || n < 0 {
+    return 0, fmt.Errorf("not a size")
+  }
+  return n * multiplier, nil
+}
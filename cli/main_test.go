@@ -0,0 +1,40 @@
+package main
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "encoding/json"
+  "testing"
+)
+
+// The exit codes documented in the README for each error code
+func TestExitCodes(t *testing.T) {
+  tests := []struct {
+    line string
+    code int
+  }{
+    {`{"version":1,"status":"success"}`, 0},
+    {`{"version":1,"status":"fail","error":{"code":"command_failed","message":"x"}}`, 1},
+    {`{"version":1,"status":"fail","error":{"code":"invalid_request","message":"x"}}`, 2},
+    {`{"version":1,"status":"fail","error":{"code":"unknown_command","message":"x"}}`, 2},
+    {`{"version":1,"status":"fail","error":{"code":"unknown_root","message":"x"}}`, 3},
+    {`{"version":1,"status":"fail","error":{"code":"not_mounted","message":"x"}}`, 4},
+    {`{"version":1,"status":"fail","error":{"code":"copy_failed","message":"x"}}`, 5},
+    {`{"version":1,"status":"fail","error":{"code":"daemon_unreachable","message":"x"}}`, 6},
+    {`{"version":1,"status":"fail","error":{"code":"permission_denied","message":"x"}}`, 7},
+    {`{"version":1,"status":"fail","error":{"code":"canceled","message":"x"}}`, 8},
+    {`{"version":1,"status":"fail","error":{"code":"from_the_future","message":"x"}}`, 1},
+  }
+  for _, test := range tests {
+    var resp processor.Response
+    if err := json.Unmarshal([]byte(test.line), &resp); err != nil {
+      t.Fatal(err)
+    }
+    if code := exitCode(resp); code != test.code {
+      t.Errorf("Expected exit code %d for %s but got %d", test.code, test.line, code)
+    }
+  }
+
+  if code := exitCode(failedResponse(processor.DaemonUnreachableError, "down")); code != ExitDaemonUnreachable {
+    t.Errorf("Expected an unreachable daemon to exit with %d but got %d", ExitDaemonUnreachable, code)
+  }
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+  "github.com/arstevens/goback/daemon/reflector"
+  "io/ioutil"
+  "strconv"
+  "fmt"
+  "os"
+)
+
+// Number of previous database versions kept next to the database
+var DBGenerations int = 3
+
+func generationPath(path string, generation int) string {
+  return path+"."+strconv.Itoa(generation)
+}
+
+/* writeDatabase() replaces path with data so that a crash at any
+point leaves either the old or the new contents. The previous
+generations are rotated with the current file becoming generation 1
+before reflector.WriteFileAtomic() renames the new contents into place */
+func writeDatabase(path string, data []byte, perm os.FileMode) error {
+  if err := rotateGenerations(path); err != nil {
+    return fmt.Errorf("Failed to rotate generations of %s in writeDatabase(): %v", path, err)
+  }
+  if err := reflector.WriteFileAtomic(path, data, perm); err != nil {
+    return fmt.Errorf("Failed to write %s in writeDatabase(): %v", path, err)
+  }
+  return nil
+}
+
+/* rotateGenerations() shifts every generation of path down by one and
+hard links the current file as generation 1 so that path itself
+never disappears */
+func rotateGenerations(path string) error {
+  if DBGenerations < 1 {
+    return nil
+  }
+  if _, err := os.Stat(path); os.IsNotExist(err) {
+    return nil
+  }
+
+  os.Remove(generationPath(path, DBGenerations))
+  for gen := DBGenerations - 1; gen >= 1; gen-- {
+    err := os.Rename(generationPath(path, gen), generationPath(path, gen + 1))
+    if err != nil && !os.IsNotExist(err) {
+      return err
+    }
+  }
+  if err := os.Link(path, generationPath(path, 1)); err != nil {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+      return err
+    }
+    return ioutil.WriteFile(generationPath(path, 1), data, 0644)
+  }
+  return nil
+}
@@ -106,7 +106,7 @@ func (f *FileMetadataDB) Keys() []string {
 
 func (f *FileMetadataDB) writeToDisk() error {
   serial := f.serializeDB()
-  err := ioutil.WriteFile(f.dbPath, serial, 0644)
+  err := writeDatabase(f.dbPath, serial, 0644)
   if err != nil {
     return fmt.Errorf("Failed to write file in FileMetadataDB.writeToDisk(): %v", err)
   }
@@ -118,7 +118,8 @@ func (f *FileMetadataDB) serializeDB() []byte {
   for _, row := range f.rowsByKey {
     serialRow := row.OriginalRoot+dbSeparator+row.ReflectionRoot+dbSeparator+
       row.ReflectionBase+dbSeparator+string(row.ReflectionCode)+dbSeparator+
-      row.DriveLabel+dbSeparator+strconv.FormatBool(row.HasChanged)
+      row.DriveLabel+dbSeparator+strconv.FormatBool(row.HasChanged)+dbSeparator+
+      strings.Join(processor.FormatRetention(row.Retention), dbSeparator)
     serial += serialRow+"\n"
   }
   return []byte(serial)
@@ -137,25 +138,51 @@ func (f *FileMetadataDB) deserializeDB() error {
     return fmt.Errorf("Failed to read from %s in FileMetadataDB.deserializeDB(): %v", f.dbPath, err)
   }
 
+  // Rows that can't be parsed are skipped so they don't take the rest with them
+  bad := make([]string, 0)
   rawRows := strings.Split(string(serial), "\n")
-  for _, rawRow := range rawRows {
-    entries := strings.Split(rawRow, dbSeparator)
-    if len(entries) < 5 {
-      return fmt.Errorf("Not enough entries when reading row in deserializeDB()")
+  for i, rawRow := range rawRows {
+    if rawRow == "" {
+      continue
     }
-    hasChanged, err := strconv.ParseBool(entries[5])
+    row, err := parseRow(rawRow)
     if err != nil {
-      return fmt.Errorf("Failed to parse bool field in deserializeDB(): %v", err)
+      bad = append(bad, fmt.Sprintf("line %d: %v", i+1, err))
+      continue
     }
+    f.rowsByKey[row.OriginalRoot] = row
+  }
+  if len(bad) > 0 {
+    return fmt.Errorf("Skipped %d unreadable rows of %s in FileMetadataDB.deserializeDB(): %s", len(bad), f.dbPath, strings.Join(bad, "; "))
+  }
+  return nil
+}
 
-    f.rowsByKey[entries[0]] = processor.MDBRow{
-      OriginalRoot: entries[0],
-      ReflectionRoot: entries[1],
-      ReflectionBase: entries[2],
-      ReflectionCode: processor.ReflectorCode(entries[3]),
-      DriveLabel: entries[4],
-      HasChanged: hasChanged,
+func parseRow(rawRow string) (processor.MDBRow, error) {
+  entries := strings.Split(rawRow, dbSeparator)
+  if len(entries) < 6 {
+    return processor.MDBRow{}, fmt.Errorf("Not enough entries when reading row in parseRow()")
+  }
+  hasChanged, err := strconv.ParseBool(entries[5])
+  if err != nil {
+    return processor.MDBRow{}, fmt.Errorf("Failed to parse bool field in parseRow(): %v", err)
+  }
+  // Rows written before retention policies existed keep everything
+  var policy processor.RetentionPolicy
+  if len(entries) > 6 {
+    policy, err = processor.ParseRetention(entries[6:])
+    if err != nil {
+      return processor.MDBRow{}, fmt.Errorf("Failed to parse retention fields in parseRow(): %v", err)
     }
   }
-  return nil
+
+  return processor.MDBRow{
+    OriginalRoot: entries[0],
+    ReflectionRoot: entries[1],
+    ReflectionBase: entries[2],
+    ReflectionCode: processor.ReflectorCode(entries[3]),
+    DriveLabel: entries[4],
+    HasChanged: hasChanged,
+    Retention: policy,
+  }, nil
 }
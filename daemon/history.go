@@ -0,0 +1,102 @@
+package main
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "encoding/json"
+  "io/ioutil"
+  "strings"
+  "bytes"
+  "fmt"
+  "log"
+  "os"
+)
+
+// Number of runs remembered for each original root
+var HistoryLimit int = 200
+
+/* AddRun() appends a run to the history file kept next to the
+database. Once a root has more than HistoryLimit runs the oldest
+are dropped and the history file is rewritten */
+func (j *JSONMetadataDB) AddRun(run processor.RunRecord) error {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  runs := append(j.runsByKey[run.OriginalRoot], run)
+  if len(runs) > HistoryLimit {
+    j.runsByKey[run.OriginalRoot] = runs[len(runs) - HistoryLimit:]
+    if err := j.writeHistory(); err != nil {
+      return fmt.Errorf("Failed to rewrite history in JSONMetadataDB.AddRun(): %v", err)
+    }
+    return nil
+  }
+  j.runsByKey[run.OriginalRoot] = runs
+
+  serial, err := json.Marshal(run)
+  if err != nil {
+    return fmt.Errorf("Failed to serialize run in JSONMetadataDB.AddRun(): %v", err)
+  }
+  out, err := os.OpenFile(j.historyPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+  if err != nil {
+    return fmt.Errorf("Failed to open history in JSONMetadataDB.AddRun(): %v", err)
+  }
+  defer out.Close()
+  if _, err = out.Write(append(serial, '\n')); err != nil {
+    return fmt.Errorf("Failed to append history in JSONMetadataDB.AddRun(): %v", err)
+  }
+  if err = out.Sync(); err != nil {
+    return fmt.Errorf("Failed to sync history in JSONMetadataDB.AddRun(): %v", err)
+  }
+  return nil
+}
+
+// Runs() returns every remembered run of key from oldest to newest
+func (j *JSONMetadataDB) Runs(key string) ([]processor.RunRecord, error) {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  runs := make([]processor.RunRecord, len(j.runsByKey[key]))
+  copy(runs, j.runsByKey[key])
+  return runs, nil
+}
+
+func (j *JSONMetadataDB) historyPath() string {
+  return j.dbPath+".history"
+}
+
+func (j *JSONMetadataDB) writeHistory() error {
+  var serial bytes.Buffer
+  encoder := json.NewEncoder(&serial)
+  encoder.SetEscapeHTML(false)
+  for _, runs := range j.runsByKey {
+    for _, run := range runs {
+      if err := encoder.Encode(run); err != nil {
+        return err
+      }
+    }
+  }
+  return writeDatabase(j.historyPath(), serial.Bytes(), 0644)
+}
+
+/* readHistory() loads the history file. A line torn by a crash
+during AddRun() is skipped rather than failing the whole history */
+func (j *JSONMetadataDB) readHistory() error {
+  serial, err := ioutil.ReadFile(j.historyPath())
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return fmt.Errorf("Failed to read %s in JSONMetadataDB.readHistory(): %v", j.historyPath(), err)
+  }
+
+  for i, line := range strings.Split(string(serial), "\n") {
+    if strings.TrimSpace(line) == "" {
+      continue
+    }
+    var run processor.RunRecord
+    if err := json.Unmarshal([]byte(line), &run); err != nil {
+      log.Printf("Skipping invalid history on line %d in JSONMetadataDB.readHistory(): %v", i + 1, err)
+      continue
+    }
+    j.runsByKey[run.OriginalRoot] = append(j.runsByKey[run.OriginalRoot], run)
+  }
+  return nil
+}
@@ -3,6 +3,7 @@ package interactor
 import (
   "github.com/arstevens/goback/daemon/processor"
   "github.com/arstevens/goback/daemon/reflector"
+  "context"
   "testing"
 )
 
@@ -20,7 +21,7 @@ func TestInteractor(t *testing.T) {
     panic(err)
   }
 
-  err = ref1.Backup()
+  err = ref1.Backup(context.Background())
   if err != nil {
     panic(err)
   }
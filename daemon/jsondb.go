@@ -0,0 +1,277 @@
+package main
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "encoding/json"
+  "io/ioutil"
+  "strings"
+  "bytes"
+  "sync"
+  "sort"
+  "fmt"
+  "log"
+  "os"
+)
+
+const (
+  jsonDBFormat string = "gobackdb"
+  jsonDBVersion int = 1
+)
+
+type jsonDBHeader struct {
+  Format string `json:"format"`
+  Version int `json:"version"`
+}
+
+/* JSONMetadataDB stores one JSON encoded MDBRow per line after a
+header line naming the format version. Fields missing from older
+files take their zero value and unknown fields are ignored so rows
+can grow without breaking existing databases */
+type JSONMetadataDB struct {
+  rowsByKey map[string]processor.MDBRow
+  runsByKey map[string][]processor.RunRecord
+  dbPath string
+  mutex *sync.Mutex
+}
+
+/* NewJSONMetadataDB() loads the database at dbLoc. If it doesn't
+exist yet but a comma separated FileMetadataDB exists at legacyLoc
+its rows are migrated and the old file is renamed out of the way.
+If dbLoc can't be parsed the newest previous generation that can
+is used instead */
+func NewJSONMetadataDB(dbLoc string, legacyLoc string) *JSONMetadataDB {
+  jdb := &JSONMetadataDB{
+    rowsByKey: make(map[string]processor.MDBRow),
+    runsByKey: make(map[string][]processor.RunRecord),
+    dbPath: dbLoc,
+    mutex: &sync.Mutex{},
+  }
+  if err := jdb.readHistory(); err != nil {
+    log.Printf("Failed to read history in NewJSONMetadataDB(): %v", err)
+  }
+
+  _, err := os.Stat(dbLoc)
+  _, genErr := os.Stat(generationPath(dbLoc, 1))
+  if os.IsNotExist(err) && os.IsNotExist(genErr) {
+    if err = jdb.migrate(legacyLoc); err != nil {
+      log.Printf("Failed to migrate %s in NewJSONMetadataDB(): %v", legacyLoc, err)
+    }
+    return jdb
+  }
+
+  if err = jdb.deserializeDB(); err != nil {
+    log.Printf("Failed to deserialize json db in NewJSONMetadataDB(): %v", err)
+  }
+  return jdb
+}
+
+func (j *JSONMetadataDB) GetRow(key string) (processor.MDBRow, error) {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  row, ok := j.rowsByKey[key]
+  if !ok {
+    return processor.MDBRow{}, fmt.Errorf("No row with key %s in JSONMetadataDB.GetRow()", key)
+  }
+  return row, nil
+}
+
+func (j *JSONMetadataDB) InsertRow(row processor.MDBRow) error {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  if _, ok := j.rowsByKey[row.OriginalRoot]; ok {
+    return fmt.Errorf("Row already exists with key %s", row.OriginalRoot)
+  }
+  j.rowsByKey[row.OriginalRoot] = row
+
+  if err := j.writeToDisk(); err != nil {
+    return fmt.Errorf("Failed to write to disk in JSONMetadataDB.InsertRow(): %v", err)
+  }
+  return nil
+}
+
+func (j *JSONMetadataDB) DeleteRow(key string) (processor.MDBRow, error) {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  row, ok := j.rowsByKey[key]
+  if !ok {
+    return processor.MDBRow{}, fmt.Errorf("Key %s does not exist in JSONMetadataDB.DeleteRow()", key)
+  }
+
+  delete(j.rowsByKey, key)
+  if err := j.writeToDisk(); err != nil {
+    return processor.MDBRow{}, fmt.Errorf("Failed to write to disk in JSONMetadataDB.DeleteRow(): %v", err)
+  }
+  return row, nil
+}
+
+func (j *JSONMetadataDB) UpdateRow(row processor.MDBRow) error {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  _, ok := j.rowsByKey[row.OriginalRoot]
+  if !ok {
+    return fmt.Errorf("Couldn't update row with key %s. Does not exist in JSONMetadataDB.UpdateRow()", row.OriginalRoot)
+  }
+
+  j.rowsByKey[row.OriginalRoot] = row
+  if err := j.writeToDisk(); err != nil {
+    return fmt.Errorf("Failed to write to disk in JSONMetadataDB.UpdateRow(): %v", err)
+  }
+  return nil
+}
+
+func (j *JSONMetadataDB) Keys() []string {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  keys := make([]string, 0, len(j.rowsByKey))
+  for key, _ := range j.rowsByKey {
+    keys = append(keys, key)
+  }
+  return keys
+}
+
+func (j *JSONMetadataDB) writeToDisk() error {
+  serial, err := j.serializeDB()
+  if err != nil {
+    return fmt.Errorf("Failed to serialize in JSONMetadataDB.writeToDisk(): %v", err)
+  }
+  err = writeDatabase(j.dbPath, serial, 0644)
+  if err != nil {
+    return fmt.Errorf("Failed to write file in JSONMetadataDB.writeToDisk(): %v", err)
+  }
+  return nil
+}
+
+func (j *JSONMetadataDB) serializeDB() ([]byte, error) {
+  var serial bytes.Buffer
+  encoder := json.NewEncoder(&serial)
+  encoder.SetEscapeHTML(false)
+
+  if err := encoder.Encode(jsonDBHeader{Format: jsonDBFormat, Version: jsonDBVersion}); err != nil {
+    return nil, err
+  }
+
+  // Sorted so the file is stable between writes
+  keys := make([]string, 0, len(j.rowsByKey))
+  for key, _ := range j.rowsByKey {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  for _, key := range keys {
+    if err := encoder.Encode(j.rowsByKey[key]); err != nil {
+      return nil, err
+    }
+  }
+  return serial.Bytes(), nil
+}
+
+/* deserializeDB() falls back through the previous generations when
+the database can't be read and rewrites whatever it recovered as
+the current database */
+func (j *JSONMetadataDB) deserializeDB() error {
+  rows, err := readJSONDB(j.dbPath)
+  if err == nil {
+    j.rowsByKey = rows
+    return nil
+  }
+  log.Printf("Failed to load %s in JSONMetadataDB.deserializeDB(): %v", j.dbPath, err)
+
+  for gen := 1; gen <= DBGenerations; gen++ {
+    genPath := generationPath(j.dbPath, gen)
+    rows, genErr := readJSONDB(genPath)
+    if genErr != nil {
+      if !os.IsNotExist(genErr) {
+        log.Printf("Failed to load %s in JSONMetadataDB.deserializeDB(): %v", genPath, genErr)
+      }
+      continue
+    }
+
+    log.Printf("Recovered %d backups from %s", len(rows), genPath)
+    for key, _ := range rows {
+      log.Printf("Recovered backup of %s", key)
+    }
+    j.rowsByKey = rows
+    if err = j.writeToDisk(); err != nil {
+      return fmt.Errorf("Failed to rewrite recovered db in JSONMetadataDB.deserializeDB(): %v", err)
+    }
+    return nil
+  }
+  return fmt.Errorf("No readable generation of %s in JSONMetadataDB.deserializeDB(): %v", j.dbPath, err)
+}
+
+func readJSONDB(path string) (map[string]processor.MDBRow, error) {
+  serial, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  rows, err := parseJSONDB(serial)
+  if err != nil {
+    return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+  }
+  return rows, nil
+}
+
+func parseJSONDB(serial []byte) (map[string]processor.MDBRow, error) {
+  lines := strings.Split(string(serial), "\n")
+  var header jsonDBHeader
+  if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+    return nil, fmt.Errorf("Invalid header: %v", err)
+  }
+  if header.Format != jsonDBFormat {
+    return nil, fmt.Errorf("Unknown format %q", header.Format)
+  }
+  if header.Version > jsonDBVersion {
+    return nil, fmt.Errorf("Version %d is newer than the supported version %d", header.Version, jsonDBVersion)
+  }
+
+  rows := make(map[string]processor.MDBRow)
+  for i, line := range lines[1:] {
+    if strings.TrimSpace(line) == "" {
+      continue
+    }
+    var row processor.MDBRow
+    if err := json.Unmarshal([]byte(line), &row); err != nil {
+      return nil, fmt.Errorf("Invalid row on line %d: %v", i + 2, err)
+    }
+    rows[row.OriginalRoot] = row
+  }
+  return rows, nil
+}
+
+/* migrate() copies the rows of a FileMetadataDB into this database
+and renames the old file so it is only ever migrated once. Rows that
+can't be read are logged and the old file is left in place instead so
+nothing is lost */
+func (j *JSONMetadataDB) migrate(legacyLoc string) error {
+  if _, err := os.Stat(legacyLoc); os.IsNotExist(err) {
+    return nil
+  }
+
+  legacy := &FileMetadataDB{
+    rowsByKey: make(map[string]processor.MDBRow),
+    dbPath: legacyLoc,
+    mutex: &sync.Mutex{},
+  }
+  readErr := legacy.deserializeDB()
+  if readErr != nil && len(legacy.rowsByKey) == 0 {
+    return fmt.Errorf("Failed to read legacy db in JSONMetadataDB.migrate(): %v", readErr)
+  }
+
+  j.rowsByKey = legacy.rowsByKey
+  if err := j.writeToDisk(); err != nil {
+    return fmt.Errorf("Failed to write migrated db in JSONMetadataDB.migrate(): %v", err)
+  }
+  if readErr != nil {
+    log.Printf("Migrated %d backups from %s to %s but kept %s: %v", len(j.rowsByKey), legacyLoc, j.dbPath, legacyLoc, readErr)
+    return nil
+  }
+  if err := os.Rename(legacyLoc, legacyLoc+".migrated"); err != nil {
+    return fmt.Errorf("Failed to rename legacy db in JSONMetadataDB.migrate(): %v", err)
+  }
+  log.Printf("Migrated %d backups from %s to %s", len(j.rowsByKey), legacyLoc, j.dbPath)
+  return nil
+}
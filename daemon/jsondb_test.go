@@ -0,0 +1,143 @@
+package main
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "path/filepath"
+  "io/ioutil"
+  "reflect"
+  "testing"
+  "os"
+)
+
+func TestJSONMetadataDB(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  // The legacy format can't hold commas so the migrated row avoids them
+  legacyFile := filepath.Join(tmp, "legacy")
+  legacy := "/home/user/docs,/run/media/user/usb/docs,/docs,pref,usb,false\n"
+  if err = ioutil.WriteFile(legacyFile, []byte(legacy), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  dbFile := filepath.Join(tmp, "db.jsonl")
+  jdb := NewJSONMetadataDB(dbFile, legacyFile)
+  if _, err = jdb.GetRow("/home/user/docs"); err != nil {
+    t.Fatalf("Expected legacy row to be migrated: %v", err)
+  }
+  if _, err = os.Stat(legacyFile); !os.IsNotExist(err) {
+    t.Errorf("Expected legacy db to be renamed after migration")
+  }
+
+  row := processor.MDBRow{
+    OriginalRoot: "/home/user/odd, name\nwith: \"everything\"",
+    ReflectionCode: "snap",
+    Retention: processor.RetentionPolicy{KeepLast: 3, MaxSize: 1 << 30},
+    HasChanged: true,
+    Changes: processor.ChangeSet{Paths: map[string][]processor.ChangeOp{
+      "docs/a.txt": []processor.ChangeOp{processor.WriteOp, processor.RemoveOp},
+    }},
+  }
+  if err = jdb.InsertRow(row); err != nil {
+    t.Fatal(err)
+  }
+
+  reloaded := NewJSONMetadataDB(dbFile, legacyFile)
+  if len(reloaded.Keys()) != 2 {
+    t.Fatalf("Expected 2 rows after reload but found %v", reloaded.Keys())
+  }
+  got, err := reloaded.GetRow(row.OriginalRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(got, row) {
+    t.Errorf("Expected %+v after reload but got %+v", row, got)
+  }
+}
+
+func TestJSONMetadataDBRecovery(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  dbFile := filepath.Join(tmp, "db.jsonl")
+  jdb := NewJSONMetadataDB(dbFile, filepath.Join(tmp, "legacy"))
+  for _, root := range []string{"/a", "/b"} {
+    if err = jdb.InsertRow(processor.MDBRow{OriginalRoot: root}); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  // A torn write of the current generation
+  if err = ioutil.WriteFile(dbFile, []byte("{\"format\":\"gobackdb\",\"vers"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  recovered := NewJSONMetadataDB(dbFile, filepath.Join(tmp, "legacy"))
+  if _, err = recovered.GetRow("/a"); err != nil {
+    t.Errorf("Expected the previous generation to be recovered: %v", err)
+  }
+  if _, err = readJSONDB(dbFile); err != nil {
+    t.Errorf("Expected the recovered rows to be written back: %v", err)
+  }
+}
+
+func TestJSONMetadataDBHistory(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  dbFile := filepath.Join(tmp, "db.jsonl")
+  jdb := NewJSONMetadataDB(dbFile, filepath.Join(tmp, "legacy"))
+  for i := 0; i < HistoryLimit + 5; i++ {
+    run := processor.RunRecord{OriginalRoot: "/a", Trigger: processor.ChangeTrigger, FilesCopied: i}
+    if err = jdb.AddRun(run); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  reloaded := NewJSONMetadataDB(dbFile, filepath.Join(tmp, "legacy"))
+  runs, err := reloaded.Runs("/a")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(runs) != HistoryLimit || runs[len(runs) - 1].FilesCopied != HistoryLimit + 4 {
+    t.Errorf("Expected the newest %d runs to be kept but found %d", HistoryLimit, len(runs))
+  }
+}
+
+func TestJSONMetadataDBPartialMigration(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  legacyFile := filepath.Join(tmp, "legacy")
+  legacy := "/home/user/docs,/run/media/user/usb/docs,/docs,pref,usb,false\n"+
+    "/home/user/broken,/run/media/user/usb/broken,/broken,pref,usb,maybe\n"+
+    "/home/user/pics,/run/media/user/usb/pics,/pics,pref,usb,true\n"
+  if err = ioutil.WriteFile(legacyFile, []byte(legacy), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  jdb := NewJSONMetadataDB(filepath.Join(tmp, "db.jsonl"), legacyFile)
+  for _, key := range []string{"/home/user/docs", "/home/user/pics"} {
+    if _, err = jdb.GetRow(key); err != nil {
+      t.Errorf("Expected readable row %s to be migrated: %v", key, err)
+    }
+  }
+  if len(jdb.Keys()) != 2 {
+    t.Errorf("Expected only the readable rows to be migrated but found %v", jdb.Keys())
+  }
+  // The unreadable row is still there to be fixed by hand
+  if serial, err := ioutil.ReadFile(legacyFile); err != nil || string(serial) != legacy {
+    t.Errorf("Expected the legacy db to be kept untouched: %v", err)
+  }
+}
@@ -6,19 +6,35 @@ import (
   "github.com/arstevens/goback/daemon/interactor"
   "path/filepath"
   "os/user"
+  "flag"
   "log"
 )
 
 const (
   PlainReflectorCode processor.ReflectorCode = "pref"
+  IncrementalReflectorCode processor.ReflectorCode = "iref"
+  SHA1ReflectorCode processor.ReflectorCode = "sref"
+  SnapshotReflectorCode processor.ReflectorCode = "snap"
 )
 
-var MetadataDBFile string = ".gobackdb"
+var MetadataDBFile string = ".gobackdb.jsonl"
+var LegacyMetadataDBFile string = ".gobackdb"
 var GobackPort int = 25000
+var GobackSocket string = "/run/goback.sock"
+var BackupWorkers int = 2
 
 func main() {
+  socket := flag.String("socket", GobackSocket, "Unix socket to accept clients on")
+  listenTCP := flag.Bool("tcp", false, "Also accept unauthenticated clients on localhost:port")
+  port := flag.Int("port", GobackPort, "Port to accept clients on with -tcp")
+  workers := flag.Int("workers", BackupWorkers, "Number of backups that may run at once")
+  flag.Parse()
+
   refTypes := map[processor.ReflectorCode]interactor.ReflectorCreator{
     PlainReflectorCode: reflector.NewPlainReflector,
+    IncrementalReflectorCode: reflector.NewIncrementalReflector,
+    SHA1ReflectorCode: reflector.NewSHA1Reflector,
+    SnapshotReflectorCode: reflector.NewSnapshotReflector,
   }
   generator := interactor.NewReflectionGenerator(refTypes)
 
@@ -27,13 +43,24 @@ func main() {
     log.Fatalf("Failed to retrieve current user in main(): %v", err)
   }
   dbFile := filepath.Join(curUser.HomeDir, MetadataDBFile)
-  mdb := NewFileMetadataDB(dbFile)
+  legacyFile := filepath.Join(curUser.HomeDir, LegacyMetadataDBFile)
+  mdb := NewJSONMetadataDB(dbFile, legacyFile)
 
-  uiChan := make(chan string)
-  sysChan := make(chan string)
-  go processor.CommandProcessor(generator, mdb, uiChan, sysChan)
-  go processor.MonitorSystem(mdb, sysChan)
-  go ListenAndRelay(GobackPort, uiChan)
+  uiChan := make(chan processor.Call)
+  sysChan := make(chan processor.Request)
+  events := processor.NewEventBus()
+  queue := processor.NewJobQueue(*workers, events)
+  go processor.CommandProcessor(generator, mdb, queue, events, uiChan, sysChan)
+  go processor.MonitorSystem(mdb, events, sysChan)
+  // Without the socket no client could reach the daemon
+  ln, err := ListenUnix(*socket)
+  if err != nil {
+    log.Fatalf("Failed to listen for clients in main(): %v", err)
+  }
+  go RelayUnix(ln, uiChan)
+  if *listenTCP {
+    go ListenAndRelay(*port, uiChan)
+  }
 
   done := make(chan struct{})
   <-done
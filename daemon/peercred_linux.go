@@ -0,0 +1,33 @@
+package main
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "syscall"
+  "fmt"
+  "net"
+)
+
+// peerCredentials() reads SO_PEERCRED of a Unix socket connection
+func peerCredentials(conn net.Conn) (*processor.Peer, error) {
+  unixConn, ok := conn.(*net.UnixConn)
+  if !ok {
+    return nil, fmt.Errorf("Not a unix socket connection in peerCredentials()")
+  }
+  raw, err := unixConn.SyscallConn()
+  if err != nil {
+    return nil, fmt.Errorf("Failed to access socket in peerCredentials(): %v", err)
+  }
+
+  var cred *syscall.Ucred
+  var credErr error
+  err = raw.Control(func(fd uintptr) {
+    cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+  })
+  if err == nil {
+    err = credErr
+  }
+  if err != nil {
+    return nil, fmt.Errorf("Failed to read peer credentials in peerCredentials(): %v", err)
+  }
+  return &processor.Peer{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "fmt"
+  "net"
+)
+
+// Peer credentials are only read on linux so everyone else is refused
+func peerCredentials(conn net.Conn) (*processor.Peer, error) {
+  return nil, fmt.Errorf("Peer credentials are not supported on this platform")
+}
@@ -0,0 +1,149 @@
+package processor
+
+import (
+  "path/filepath"
+  "syscall"
+  "os"
+)
+
+/* authorize() decides whether peer may run req. Root and unidentified
+peers may run anything. Other users may read the state of every backup,
+register backups of paths they own into paths they own and manage and
+restore the backups they registered. Commands that aren't listed here
+are refused. Ownership of a path can change once it has been checked
+so jobs of backups registered by other users do all their file work
+as that user (see runAs()) */
+func authorize(req Request, peer *Peer, mdb MetadataDB, queue *JobQueue) error {
+  if peer == nil || peer.UID == 0 {
+    return nil
+  }
+
+  switch req.Command {
+    case ListCommand, StatusCommand, HistoryCommand, JobCommand, SubscribeCommand:
+      return nil
+    case NewBackupCommand:
+      var args NewBackupArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      if err := checkOwner(args.Original, peer.UID); err != nil {
+        return err
+      }
+      return checkOwner(args.Reflection, peer.UID)
+    case BackupCommand:
+      var args BackupArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      return checkRootOwner(req.Command, args.Root, peer, mdb)
+    case UnbackupCommand, PauseCommand, ResumeCommand:
+      var args RootArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      return checkRootOwner(req.Command, args.Root, peer, mdb)
+    case RetentionCommand:
+      var args RetentionArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      return checkRootOwner(req.Command, args.Root, peer, mdb)
+    case SettleCommand:
+      var args SettleArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      return checkRootOwner(req.Command, args.Root, peer, mdb)
+    case DetectionCommand:
+      var args DetectionArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      return checkRootOwner(req.Command, args.Root, peer, mdb)
+    case PruneCommand:
+      var args PruneArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      return checkRootOwner(req.Command, args.Root, peer, mdb)
+    case CancelCommand:
+      var args CancelArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      if args.ID != "" {
+        job, err := queue.Get(args.ID)
+        if err != nil {
+          return err
+        }
+        args.Root = job.Root
+      }
+      return checkRootOwner(req.Command, args.Root, peer, mdb)
+    case RestoreCommand:
+      var args RestoreArgs
+      if err := decodeArgs(req, &args); err != nil {
+        return err
+      }
+      root := args.Root
+      if root == "" {
+        root = args.Path
+      }
+      if err := checkRootOwner(req.Command, root, peer, mdb); err != nil {
+        return err
+      }
+      if args.Target == "" {
+        return nil
+      }
+      return checkOwner(args.Target, peer.UID)
+  }
+  return newError(PermissionDeniedError, "Only root may run %s", req.Command)
+}
+
+/* checkRootOwner() reports a PermissionDeniedError unless the backup
+root containing path was registered by peer. The owner is taken from
+the database rather than the file system so it can't be changed by
+swapping paths. An empty path stands for every root which only root
+may act on */
+func checkRootOwner(cmd CommandCode, path string, peer *Peer, mdb MetadataDB) error {
+  if path == "" {
+    return newError(PermissionDeniedError, "Only root may run %s on every backup at once", cmd)
+  }
+  root, err := resolveRoot(path, mdb)
+  if err != nil {
+    return err
+  }
+  mdbRow, err := getRow(root, mdb)
+  if err != nil {
+    return err
+  }
+  if mdbRow.OwnerUID != peer.UID {
+    return newError(PermissionDeniedError, "The backup of %s belongs to another user", root)
+  }
+  return nil
+}
+
+/* checkOwner() reports a PermissionDeniedError unless path is owned
+by uid. Paths that don't exist yet belong to the owner of their
+nearest existing parent. Symlinks are followed so linking to a path
+owned by somebody else doesn't grant access to it */
+func checkOwner(path string, uid uint32) error {
+  if !filepath.IsAbs(path) {
+    return newError(PermissionDeniedError, "%q must be an absolute path", path)
+  }
+
+  existing := filepath.Clean(path)
+  fi, err := os.Stat(existing)
+  for os.IsNotExist(err) && existing != filepath.Dir(existing) {
+    existing = filepath.Dir(existing)
+    fi, err = os.Stat(existing)
+  }
+  if err != nil {
+    return newError(PermissionDeniedError, "Couldn't check the owner of %s: %v", path, err)
+  }
+
+  st, ok := fi.Sys().(*syscall.Stat_t)
+  if !ok || st.Uid != uid {
+    return newError(PermissionDeniedError, "%s is not owned by uid %d", path, uid)
+  }
+  return nil
+}
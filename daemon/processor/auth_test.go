@@ -0,0 +1,174 @@
+package processor
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "syscall"
+  "testing"
+  "os"
+)
+
+func TestAuthorize(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  // foreign belongs to whoever runs the tests, own to the peer
+  const uid = 4242
+  foreign := filepath.Join(tmp, "foreign")
+  own := filepath.Join(tmp, "own")
+  for _, dir := range []string{foreign, own} {
+    if err = os.Mkdir(dir, 0755); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if os.Geteuid() == 0 {
+    if err = os.Chown(own, uid, uid); err != nil {
+      t.Fatal(err)
+    }
+  } else {
+    t.Skip("Peers can only be given their own directory when running as root")
+  }
+  link := filepath.Join(own, "link")
+  if err = os.Symlink(foreign, link); err != nil {
+    t.Fatal(err)
+  }
+
+  // The backup of own belongs to the peer and the one of foreign to root
+  mdb := &TestMDB{db: make(map[string]MDBRow)}
+  mdb.InsertRow(MDBRow{OriginalRoot: own, OwnerUID: uid, OwnerGID: uid})
+  mdb.InsertRow(MDBRow{OriginalRoot: foreign})
+  queue := NewJobQueue(1, nil)
+  release := make(chan struct{})
+  defer close(release)
+  started := make(chan string, 2)
+  ownJob := queue.Enqueue(own, "drive", ManualTrigger, true, blockingJob(started, "own", release))
+  foreignJob := queue.Enqueue(foreign, "drive", ManualTrigger, true, blockingJob(started, "foreign", release))
+
+  user, root := &Peer{UID: uid, GID: uid}, &Peer{UID: 0}
+  tests := []struct {
+    name string
+    peer *Peer
+    cmd CommandCode
+    args interface{}
+    allowed bool
+  }{
+    {"list", user, ListCommand, RootArgs{}, true},
+    {"status", user, StatusCommand, RootArgs{Root: foreign}, true},
+    {"history", user, HistoryCommand, RootArgs{Root: foreign}, true},
+    {"job", user, JobCommand, JobArgs{ID: "1", Wait: true}, true},
+    {"subscribe", user, SubscribeCommand, struct{}{}, true},
+    {"own new backup", user, NewBackupCommand, NewBackupArgs{Original: own, Reflection: filepath.Join(own, "new", "dir")}, true},
+    {"foreign new backup", user, NewBackupCommand, NewBackupArgs{Original: foreign, Reflection: own}, false},
+    {"into foreign", user, NewBackupCommand, NewBackupArgs{Original: own, Reflection: foreign}, false},
+    {"symlink to foreign", user, NewBackupCommand, NewBackupArgs{Original: link, Reflection: own}, false},
+    {"missing under foreign", user, NewBackupCommand, NewBackupArgs{Original: own, Reflection: filepath.Join(foreign, "new", "dir")}, false},
+    {"relative path", user, NewBackupCommand, NewBackupArgs{Original: "own", Reflection: own}, false},
+    {"own backup", user, BackupCommand, BackupArgs{Root: own}, true},
+    {"path inside own backup", user, BackupCommand, BackupArgs{Root: filepath.Join(own, "sub")}, true},
+    {"foreign backup", user, BackupCommand, BackupArgs{Root: foreign}, false},
+    {"every backup", user, BackupCommand, BackupArgs{}, false},
+    {"cancel own job", user, CancelCommand, CancelArgs{ID: ownJob.ID}, true},
+    {"cancel foreign job", user, CancelCommand, CancelArgs{ID: foreignJob.ID}, false},
+    {"cancel own root", user, CancelCommand, CancelArgs{Root: own}, true},
+    {"cancel everything", user, CancelCommand, CancelArgs{}, false},
+    {"pause own", user, PauseCommand, RootArgs{Root: own}, true},
+    {"pause everything", user, PauseCommand, RootArgs{}, false},
+    {"resume foreign", user, ResumeCommand, RootArgs{Root: foreign}, false},
+    {"resume everything", user, ResumeCommand, RootArgs{}, false},
+    {"remove own", user, UnbackupCommand, RootArgs{Root: own}, true},
+    {"remove foreign", user, UnbackupCommand, RootArgs{Root: foreign}, false},
+    {"retention", user, RetentionCommand, RetentionArgs{Root: foreign}, false},
+    {"prune", user, PruneCommand, PruneArgs{Root: foreign}, false},
+    {"settle", user, SettleCommand, SettleArgs{Root: own}, true},
+    {"detection", user, DetectionCommand, DetectionArgs{Root: foreign}, false},
+    {"restore own", user, RestoreCommand, RestoreArgs{Root: own}, true},
+    {"restore own path", user, RestoreCommand, RestoreArgs{Path: filepath.Join(own, "a.txt"), Target: filepath.Join(own, "out")}, true},
+    {"restore to foreign", user, RestoreCommand, RestoreArgs{Root: own, Target: foreign}, false},
+    {"restore to symlink", user, RestoreCommand, RestoreArgs{Root: own, Target: link}, false},
+    {"restore from foreign", user, RestoreCommand, RestoreArgs{Root: foreign, Target: own}, false},
+    {"restore foreign path", user, RestoreCommand, RestoreArgs{Path: filepath.Join(foreign, "a.txt"), Target: own}, false},
+    {"unknown command", user, CommandCode("xyz"), struct{}{}, false},
+    {"root backs up everything", root, BackupCommand, BackupArgs{}, true},
+    {"root restores anywhere", root, RestoreCommand, RestoreArgs{Root: own, Target: foreign}, true},
+    {"unidentified peer", nil, CancelCommand, CancelArgs{}, true},
+  }
+
+  for _, test := range tests {
+    req, err := NewRequest("", test.cmd, test.args)
+    if err != nil {
+      t.Fatal(err)
+    }
+    err = authorize(req, test.peer, mdb, queue)
+    if test.allowed && err != nil {
+      t.Errorf("%s: Expected to be allowed but got %v", test.name, err)
+    } else if !test.allowed {
+      if err == nil {
+        t.Errorf("%s: Expected to be refused", test.name)
+      } else if code := toProtocolError(err).Code; code != PermissionDeniedError {
+        t.Errorf("%s: Expected %s but got %s", test.name, PermissionDeniedError, code)
+      }
+    }
+  }
+}
+
+func TestRunAs(t *testing.T) {
+  if os.Geteuid() != 0 {
+    t.Skip("Only root can act as another user")
+  }
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+  os.Chmod(tmp, 0755)
+
+  const uid = 4242
+  secret := filepath.Join(tmp, "secret")
+  if err = ioutil.WriteFile(secret, []byte("root only"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  own := filepath.Join(tmp, "own")
+  if err = os.Mkdir(own, 0755); err != nil {
+    t.Fatal(err)
+  }
+  if err = os.Chown(own, uid, uid); err != nil {
+    t.Fatal(err)
+  }
+
+  err = runAs(uid, uid, func() error {
+    _, err := ioutil.ReadFile(secret)
+    return err
+  })
+  if !os.IsPermission(err) {
+    t.Errorf("Expected reading a file of root to be refused but got %v", err)
+  }
+  err = runAs(uid, uid, func() error {
+    return ioutil.WriteFile(filepath.Join(tmp, "planted"), nil, 0644)
+  })
+  if !os.IsPermission(err) {
+    t.Errorf("Expected writing into a directory of root to be refused but got %v", err)
+  }
+
+  created := filepath.Join(own, "created")
+  err = runAs(uid, uid, func() error {
+    return ioutil.WriteFile(created, nil, 0644)
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  fi, err := os.Stat(created)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if st := fi.Sys().(*syscall.Stat_t); st.Uid != uid || st.Gid != uid {
+    t.Errorf("Expected files to be created as %d:%d but got %d:%d", uid, uid, st.Uid, st.Gid)
+  }
+
+  // The ids of the daemon itself are left alone
+  if _, err = ioutil.ReadFile(secret); err != nil {
+    t.Errorf("Expected root to still read its own file but got %v", err)
+  }
+}
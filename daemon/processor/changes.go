@@ -0,0 +1,141 @@
+package processor
+
+import (
+  "path/filepath"
+  "strings"
+  "sort"
+)
+
+type ChangeOp string
+
+const (
+  CreateOp ChangeOp = "create"
+  WriteOp = "write"
+  RemoveOp = "remove"
+  RenameOp = "rename"
+)
+
+// Change sets of more paths than this are replaced by a full backup
+var MaxChangeSetPaths int = 10000
+
+/* Change is a single path below Root that changed. Path is
+absolute and empty when something changed but it isn't known where */
+type Change struct {
+  Root string
+  Path string
+  Op ChangeOp
+}
+
+/* ChangeSet collects every path below a root that changed since its
+last backup along with what happened to it. Paths are relative to the
+root. Full is set when it isn't known what changed and the whole root
+has to be backed up. ChangeSets may be shared with a MetadataDB so
+they are never modified in place */
+type ChangeSet struct {
+  Full bool `json:"full,omitempty"`
+  Paths map[string][]ChangeOp `json:"paths,omitempty"`
+}
+
+// FullChangeSet() is the change set of a root that has to be backed up whole
+func FullChangeSet() ChangeSet {
+  return ChangeSet{Full: true}
+}
+
+func (c ChangeSet) IsEmpty() bool {
+  return !c.Full && len(c.Paths) == 0
+}
+
+/* NewChangeSet() collects changes below root into a ChangeSet.
+Changes without a path or outside of root make the set full */
+func NewChangeSet(root string, changes []Change) ChangeSet {
+  set := ChangeSet{Paths: make(map[string][]ChangeOp)}
+  for _, change := range changes {
+    rel, err := filepath.Rel(root, change.Path)
+    if change.Path == "" || err != nil || rel == "." || rel == ".." ||
+      strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+      return FullChangeSet()
+    }
+    if !containsOp(set.Paths[rel], change.Op) {
+      set.Paths[rel] = append(set.Paths[rel], change.Op)
+    }
+  }
+  if len(set.Paths) > MaxChangeSetPaths {
+    return FullChangeSet()
+  }
+  return set
+}
+
+// Merge() returns every change of c and other
+func (c ChangeSet) Merge(other ChangeSet) ChangeSet {
+  if c.Full || other.Full {
+    return FullChangeSet()
+  }
+
+  merged := ChangeSet{Paths: make(map[string][]ChangeOp, len(c.Paths) + len(other.Paths))}
+  for _, set := range []ChangeSet{c, other} {
+    for path, ops := range set.Paths {
+      for _, op := range ops {
+        if !containsOp(merged.Paths[path], op) {
+          merged.Paths[path] = append(merged.Paths[path], op)
+        }
+      }
+    }
+  }
+  if len(merged.Paths) > MaxChangeSetPaths {
+    return FullChangeSet()
+  }
+  return merged
+}
+
+// Has() reports whether op happened to path
+func (c ChangeSet) Has(path string, op ChangeOp) bool {
+  return containsOp(c.Paths[path], op)
+}
+
+// Sorted() returns the changed paths with parents before their children
+func (c ChangeSet) Sorted() []string {
+  paths := make([]string, 0, len(c.Paths))
+  for path := range c.Paths {
+    paths = append(paths, path)
+  }
+  sort.Strings(paths)
+  return paths
+}
+
+func containsOp(ops []ChangeOp, op ChangeOp) bool {
+  for _, have := range ops {
+    if have == op {
+      return true
+    }
+  }
+  return false
+}
+
+/* recordChanges() adds changes to the change set of root and marks
+it as changed. Returns whether root was unchanged before */
+func recordChanges(root string, changes ChangeSet, mdb MetadataDB) (bool, error) {
+  wasUnchanged := false
+  err := modifyRow(root, mdb, func(mdbRow *MDBRow) {
+    wasUnchanged = !mdbRow.HasChanged
+    mdbRow.Changes = mdbRow.Changes.Merge(changes)
+    mdbRow.HasChanged = true
+  })
+  return wasUnchanged, err
+}
+
+/* takeChanges() returns the change set of root and clears it along
+with the changed flag. A root marked as changed without any recorded
+changes, such as one changed before change sets were kept, gets a
+full change set */
+func takeChanges(root string, mdb MetadataDB) (ChangeSet, error) {
+  var changes ChangeSet
+  err := modifyRow(root, mdb, func(mdbRow *MDBRow) {
+    changes = mdbRow.Changes
+    if mdbRow.HasChanged && changes.IsEmpty() {
+      changes = FullChangeSet()
+    }
+    mdbRow.Changes = ChangeSet{}
+    mdbRow.HasChanged = false
+  })
+  return changes, err
+}
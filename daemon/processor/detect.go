@@ -3,8 +3,9 @@ package processor
 import (
   "os"
   "fmt"
+  "log"
   "time"
-  "reflect"
+  "strings"
   "path/filepath"
   "github.com/fsnotify/fsnotify"
 )
@@ -16,103 +17,345 @@ func (t *TimeoutErr) Error() string {
 }
 var NextChangeTimeout time.Duration = 0
 
+/* fsDetector watches every directory under each root with a single
+fsnotify.Watcher and reports which paths change. Each change belongs
+to the innermost root containing it so roots may be nested. Directories
+created later are watched as they appear and watches of directories
+that are removed or renamed away are dropped. Roots that can't be
+watched are polled by a pollScanner instead */
 type fsDetector struct {
-  watchers []*fsnotify.Watcher
-  cases []reflect.SelectCase
-  keymap map[int]string
+  watcher *fsnotify.Watcher
+  roots map[string]bool
+  polled map[string]*pollScanner
+  scans chan []Change
+  watched map[string]bool
+  pending []Change
   closed bool
 }
 
 func newFsDetector() *fsDetector {
   return &fsDetector{
-    watchers: make([]*fsnotify.Watcher, 0),
-    cases: make([]reflect.SelectCase, 0),
-    keymap: make(map[int]string),
+    roots: make(map[string]bool),
+    polled: make(map[string]*pollScanner),
+    scans: make(chan []Change),
+    watched: make(map[string]bool),
+    pending: make([]Change, 0),
     closed: false,
   }
 }
 
+/* Watch() watches root with inotify and falls back to polling it
+when its watches can't be added, such as when the user ran out of
+inotify watches */
 func (f *fsDetector) Watch(root string) error {
   if f.closed {
     return fmt.Errorf("fsDetector is closed")
   }
+  root = filepath.Clean(root)
+  if f.isRoot(root) {
+    return fmt.Errorf("Already watching %s in fsDetector.Watch()", root)
+  }
 
-  watcher, err := fsnotify.NewWatcher()
-  if err != nil {
-    return fmt.Errorf("Couldn't retrieve new watcher in fsDetector.Watch(): %v", err)
+  // The watcher is only created once there is something to watch
+  if f.watcher == nil {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+      log.Printf("Couldn't retrieve new watcher in fsDetector.Watch(), polling %s: %v", root, err)
+      return f.Poll(root)
+    }
+    f.watcher = watcher
   }
 
-  err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
-  	if fi.Mode().IsDir() {
-  		return watcher.Add(path)
-  	}
-  	return nil
-  })
+  if _, err := os.Stat(root); err != nil {
+    return fmt.Errorf("Couldn't stat %s in fsDetector.Watch(): %v", root, err)
+  }
+  f.roots[root] = true
+  if _, err := f.watchTree(root); err != nil {
+    log.Printf("Couldn't watch %s in fsDetector.Watch(), polling it instead: %v", root, err)
+    f.fallBack(root)
+  }
+  return nil
+}
 
-  if err != nil {
-    return fmt.Errorf("Couldn't walk %s in watchDirectory(): %v", root, err)
+// Poll() watches root by scanning it every ScanInterval
+func (f *fsDetector) Poll(root string) error {
+  if f.closed {
+    return fmt.Errorf("fsDetector is closed")
+  }
+  root = filepath.Clean(root)
+  if f.isRoot(root) {
+    return fmt.Errorf("Already watching %s in fsDetector.Poll()", root)
   }
 
-  f.watchers = append(f.watchers, watcher)
-  newCase := reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(watcher.Events)}
-  f.cases = append(f.cases, newCase)
-  f.keymap[len(f.watchers) - 1] = root
+  scanner, err := newPollScanner(root)
+  if err != nil {
+    return fmt.Errorf("Couldn't poll %s in fsDetector.Poll(): %v", root, err)
+  }
+  f.polled[root] = scanner
+  go scanner.run(f.scans)
   return nil
 }
 
+/* fallBack() switches an inotify root over to polling. Changes
+made while switching can't be told apart so the whole root is
+marked as changed */
+func (f *fsDetector) fallBack(root string) {
+  delete(f.roots, root)
+  f.releaseTree(root)
+  if err := f.Poll(root); err != nil {
+    log.Printf("Failed to fall back to polling in fsDetector.fallBack(): %v", err)
+    return
+  }
+  f.pending = append(f.pending, Change{Root: root, Op: WriteOp})
+}
+
+func (f *fsDetector) isRoot(root string) bool {
+  _, polled := f.polled[root]
+  return f.roots[root] || polled
+}
+
 func (f *fsDetector) Unwatch(root string) error {
   if f.closed {
     return fmt.Errorf("fsDetector is closed")
   }
+  root = filepath.Clean(root)
+  if scanner, ok := f.polled[root]; ok {
+    scanner.Stop()
+    delete(f.polled, root)
+    return nil
+  }
+  if !f.roots[root] {
+    return fmt.Errorf("No watch on %s in fsDetector.Unwatch()", root)
+  }
+
+  delete(f.roots, root)
+  f.releaseTree(root)
+  return nil
+}
+
+/* NextChange() returns the next change below any root. Changes to
+a root itself are returned without a path. When the kernel dropped
+events a change without a path is returned for every root */
+func (f *fsDetector) NextChange() (Change, error) {
+  if f.closed {
+    return Change{}, fmt.Errorf("fsDetector is closed")
+  }
+
+  var timeout <-chan time.Time
+  if NextChangeTimeout > 0 {
+    timeout = time.After(NextChangeTimeout)
+  }
+  // Without a watcher both channels are nil and only the timeout fires
+  var events <-chan fsnotify.Event
+  var errors <-chan error
+  if f.watcher != nil {
+    events, errors = f.watcher.Events, f.watcher.Errors
+  }
 
-  watcherIdx := -1
-  for key, val := range f.keymap {
-    if val == root {
-      watcherIdx = key
-      break
+  for len(f.pending) == 0 {
+    select {
+      case event, ok := <-events:
+        if !ok {
+          return Change{}, fmt.Errorf("Watcher closed in fsDetector.NextChange()")
+        }
+        f.followEvent(event)
+      case err, ok := <-errors:
+        if !ok {
+          return Change{}, fmt.Errorf("Watcher closed in fsDetector.NextChange()")
+        }
+        f.followError(err)
+      case changes := <-f.scans:
+        f.followScan(changes)
+      case <-timeout:
+        return Change{}, &TimeoutErr{}
     }
   }
 
-  if watcherIdx == -1 {
-    return fmt.Errorf("No watch on %s in fsDetector.Unwatch()", root)
+  change := f.pending[0]
+  f.pending = f.pending[1:]
+  return change, nil
+}
+
+/* followError() logs errors of the watcher. Events lost to an
+overflowing queue could have been anywhere so every root is marked
+as changed without a path */
+func (f *fsDetector) followError(err error) {
+  log.Printf("Watcher failed in fsDetector.NextChange(): %v", err)
+  if err != fsnotify.ErrEventOverflow {
+    return
+  }
+  for root := range f.roots {
+    f.pending = append(f.pending, Change{Root: root, Op: WriteOp})
   }
-  delete(f.keymap, watcherIdx)
+}
 
-  watcher := f.watchers[watcherIdx]
-  if watcherIdx == len(f.watchers) - 1 {
-    f.watchers = f.watchers[:watcherIdx]
-    f.cases = f.cases[:watcherIdx]
-  } else {
-    f.watchers = append(f.watchers[:watcherIdx], f.watchers[watcherIdx+1:]...)
-    f.cases = append(f.cases[:watcherIdx], f.cases[watcherIdx+1:]...)
+/* followScan() queues the changes a pollScanner found. They are
+handed to the innermost root containing them and dropped if their
+root was unwatched since */
+func (f *fsDetector) followScan(changes []Change) {
+  for _, change := range changes {
+    if !f.isRoot(change.Root) {
+      continue
+    }
+    if change.Path != "" {
+      change.Root = f.rootOf(change.Path)
+    }
+    f.pending = append(f.pending, change)
   }
+}
 
-  watcher.Close()
-  return nil
+/* rootOf() returns the innermost root that is or contains path and
+an empty string if there is none */
+func (f *fsDetector) rootOf(path string) string {
+  owner := ""
+  for root := range f.roots {
+    owner = innerRoot(path, root, owner)
+  }
+  for root := range f.polled {
+    owner = innerRoot(path, root, owner)
+  }
+  return owner
 }
 
-func (f *fsDetector) NextChange() (string, error) {
-  if f.closed {
-    return "", fmt.Errorf("fsDetector is closed")
+// innerRoot() returns root if it contains path and is inside owner
+func innerRoot(path string, root string, owner string) string {
+  if (path == root || isBelow(path, root)) && len(root) > len(owner) {
+    return root
   }
+  return owner
+}
 
-  cases := f.cases
-  if NextChangeTimeout > 0 {
-    timeoutCase := reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(NextChangeTimeout))}
-    cases = append(cases, timeoutCase)
+/* followEvent() queues the change of an event and keeps the watches
+in step with the directories of each root. Anything a new directory
+already holds was created before its watch landed and never produced
+an event of its own so a change is queued for each of those too */
+func (f *fsDetector) followEvent(event fsnotify.Event) {
+  // Late events of a removed watch no longer know their full path
+  root := f.rootOf(event.Name)
+  if root == "" {
+    return
+  }
+  if event.Name == root {
+    f.pending = append(f.pending, Change{Root: root, Op: changeOp(event.Op)})
+    return
+  }
+  f.pending = append(f.pending, Change{Root: root, Path: event.Name, Op: changeOp(event.Op)})
+
+  if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+    f.unwatchTree(event.Name)
+  }
+  if event.Op&fsnotify.Create == 0 {
+    return
+  }
+
+  fi, err := os.Lstat(event.Name)
+  if err != nil || !fi.IsDir() {
+    return
+  }
+  found, err := f.watchTree(event.Name)
+  if err != nil {
+    log.Printf("Couldn't watch new directory %s in fsDetector.NextChange(), polling %s instead: %v", event.Name, root, err)
+    if f.roots[root] {
+      f.fallBack(root)
+    }
+    return
+  }
+  for _, path := range found {
+    f.pending = append(f.pending, Change{Root: f.rootOf(path), Path: path, Op: CreateOp})
+  }
+}
+
+// Changes of permissions are treated as writes
+func changeOp(op fsnotify.Op) ChangeOp {
+  switch {
+    case op&fsnotify.Create != 0:
+      return CreateOp
+    case op&fsnotify.Remove != 0:
+      return RemoveOp
+    case op&fsnotify.Rename != 0:
+      return RenameOp
+  }
+  return WriteOp
+}
+
+/* watchTree() adds a watch on dir and every directory below it.
+Entries that vanish during the walk are skipped. Returns every path
+found besides dir itself */
+func (f *fsDetector) watchTree(dir string) ([]string, error) {
+  found := make([]string, 0)
+  err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+    if err != nil {
+      if os.IsNotExist(err) {
+        return nil
+      }
+      return err
+    }
+    if path != dir {
+      found = append(found, path)
+    }
+    if !fi.IsDir() || f.watched[path] {
+      return nil
+    }
+    if err = f.watcher.Add(path); err != nil {
+      if os.IsNotExist(err) {
+        return filepath.SkipDir
+      }
+      return err
+    }
+    f.watched[path] = true
+    return nil
+  })
+  return found, err
+}
+
+// unwatchTree() drops the watches of dir and every directory below it
+func (f *fsDetector) unwatchTree(dir string) {
+  for path := range f.watched {
+    if path != dir && !isBelow(path, dir) {
+      continue
+    }
+    delete(f.watched, path)
+    // Deleted directories have already lost their watch
+    f.watcher.Remove(path)
+  }
+}
+
+/* releaseTree() drops the watches of dir and every directory below
+it that no longer belong to any watched root */
+func (f *fsDetector) releaseTree(dir string) {
+  for path := range f.watched {
+    if (path == dir || isBelow(path, dir)) && !f.isWatched(path) {
+      delete(f.watched, path)
+      f.watcher.Remove(path)
+    }
+  }
+}
+
+// isWatched() reports whether path is inside a root watched with inotify
+func (f *fsDetector) isWatched(path string) bool {
+  for root := range f.roots {
+    if path == root || isBelow(path, root) {
+      return true
+    }
   }
-  chosen, _, ok := reflect.Select(cases)
-  if !ok {
-    return "", fmt.Errorf("Failed to select value in fsDetector.NextChange()")
-  } else if chosen == len(f.cases) {
-    return "", &TimeoutErr{}
+  return false
+}
+
+// isBelow() reports whether path is somewhere inside dir
+func isBelow(path string, dir string) bool {
+  prefix := dir
+  if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+    prefix += string(filepath.Separator)
   }
-  return f.keymap[chosen], nil
+  return path != dir && strings.HasPrefix(path, prefix)
 }
 
 func (f *fsDetector) Close() {
-  for _, watcher := range f.watchers {
-    watcher.Close()
+  if f.watcher != nil {
+    f.watcher.Close()
+  }
+  for _, scanner := range f.polled {
+    scanner.Stop()
   }
   f.closed = true
 }
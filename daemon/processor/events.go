@@ -0,0 +1,90 @@
+package processor
+
+import (
+  "sync"
+  "time"
+)
+
+type EventType string
+
+const (
+  ChangeDetectedEvent EventType = "change_detected"
+  DriveMountedEvent = "drive_mounted"
+  DriveUnmountedEvent = "drive_unmounted"
+  BackupStartedEvent = "backup_started"
+  BackupProgressEvent = "backup_progress"
+  BackupFinishedEvent = "backup_finished"
+  BackupFailedEvent = "backup_failed"
+  RootAddedEvent = "root_added"
+  RootRemovedEvent = "root_removed"
+)
+
+// Number of events a subscriber may fall behind before losing some
+var EventBacklog int = 64
+
+/* Event is something that happened in the daemon. Drive is set for
+drive events and Job for backup events. Canceled backups are
+reported as failed with a canceled job */
+type Event struct {
+  Type EventType `json:"type"`
+  Time time.Time `json:"time"`
+  Root string `json:"root,omitempty"`
+  Drive string `json:"drive,omitempty"`
+  Job *Job `json:"job,omitempty"`
+}
+
+/* EventBus hands every published Event to each subscriber. Events
+are dropped for subscribers that don't keep up rather than holding
+up the daemon. A nil EventBus discards everything */
+type EventBus struct {
+  mutex *sync.Mutex
+  subscribers map[chan Event]bool
+}
+
+func NewEventBus() *EventBus {
+  return &EventBus{
+    mutex: &sync.Mutex{},
+    subscribers: make(map[chan Event]bool),
+  }
+}
+
+/* Subscribe() returns a channel receiving every event published
+from now on until it is passed to Unsubscribe() */
+func (b *EventBus) Subscribe() <-chan Event {
+  c := make(chan Event, EventBacklog)
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  b.subscribers[c] = true
+  return c
+}
+
+// Unsubscribe() stops and closes a channel returned by Subscribe()
+func (b *EventBus) Unsubscribe(c <-chan Event) {
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  for sub := range b.subscribers {
+    if sub == c {
+      delete(b.subscribers, sub)
+      close(sub)
+    }
+  }
+}
+
+// Publish() stamps event with the current time if it has none
+func (b *EventBus) Publish(event Event) {
+  if b == nil {
+    return
+  }
+  if event.Time.IsZero() {
+    event.Time = time.Now()
+  }
+
+  b.mutex.Lock()
+  defer b.mutex.Unlock()
+  for sub := range b.subscribers {
+    select {
+      case sub<-event:
+      default:
+    }
+  }
+}
@@ -1,5 +1,10 @@
 package processor
 
+import (
+  "context"
+  "time"
+)
+
 var (
   FailCode string = "fail"
   SuccessCode = "success"
@@ -7,22 +12,195 @@ var (
 
 type ReflectorCode string
 type ChangeMapCode string
+type ConflictPolicy string
+type BackupTrigger string
+type DetectionMode string
+
+const (
+  OverwriteConflicts ConflictPolicy = "overwrite"
+  SkipConflicts = "skip"
+  KeepBothConflicts = "keep-both"
+)
+
+/* Roots are watched with inotify unless they are set to be polled.
+Roots whose watches can't be added are polled as well */
+const (
+  AutoDetection DetectionMode = "auto"
+  PollDetection = "poll"
+)
 
+const (
+  ChangeTrigger BackupTrigger = "change"
+  MountTrigger = "mount"
+  ManualTrigger = "manual"
+)
+
+/* Backup() stops early with an error wrapping ctx.Err() once ctx
+is canceled. Whatever it left behind is finished by the next backup */
 type Reflector interface {
-  Backup() error
+  Backup(ctx context.Context) error
+}
+
+type BackupStats struct {
+  FilesCopied int `json:"files_copied"`
+  BytesCopied int64 `json:"bytes_copied"`
+}
+
+/* Reflectors implement StatsReporter to report what
+their most recent Backup() copied */
+type StatsReporter interface {
+  Stats() BackupStats
+}
+
+type ProgressPhase string
+
+const (
+  ScanningPhase ProgressPhase = "scanning"
+  CopyingPhase = "copying"
+)
+
+/* BackupProgress is how far a running backup has come. While
+scanning the original only FilesScanned and BytesTotal grow. When
+copying BytesDone counts every file dealt with whether it had to be
+copied or not so it ends at BytesTotal. ETA is estimated by the
+JobQueue from how fast BytesDone grows */
+type BackupProgress struct {
+  Phase ProgressPhase `json:"phase"`
+  FilesScanned int `json:"files_scanned"`
+  FilesCopied int `json:"files_copied"`
+  BytesDone int64 `json:"bytes_done"`
+  BytesTotal int64 `json:"bytes_total"`
+  CurrentFile string `json:"current_file,omitempty"`
+  ETA time.Duration `json:"eta,omitempty"`
+}
+
+/* Reflectors implement ProgressReporter to send updates on c
+during every later Backup(). Updates are dropped rather than
+holding up the backup when nobody is reading them */
+type ProgressReporter interface {
+  ReportProgress(c chan<- BackupProgress)
+}
+
+/* Reflectors implement ChangeSetter to limit their next Backup()
+to the paths of a ChangeSet instead of going through the whole root.
+It is only called with sets that aren't full */
+type ChangeSetter interface {
+  SetChanges(ChangeSet)
+}
+
+/* A ChangeMap is a manifest of every path under a backup root
+mapped to a hash of its contents. Directories map to an empty hash */
+type ChangeMap interface {
+  Code() ChangeMapCode
+  Lookup(string) (string, bool)
+  Paths() []string
+  Save(string) error
+}
+
+/* Reflectors that keep more than one copy of a backup
+implement Pruner so old copies can be removed according to
+a RetentionPolicy. Prune() returns what was (or with dryRun
+set, what would be) removed */
+type Pruner interface {
+  Prune(policy RetentionPolicy, dryRun bool) ([]string, error)
+}
+
+/* RestoreOptions describe where and how a reflection is copied
+back. Path limits the restore to one file or directory relative to
+the backup root and it is restored to the same place under Target.
+An empty Snapshot means the newest copy taken no later than At, or
+simply the newest if At is zero. Policy decides what happens to
+files that already exist in Target */
+type RestoreOptions struct {
+  Target string
+  Path string
+  Snapshot string
+  At time.Time
+  Policy ConflictPolicy
+  DryRun bool
+}
+
+/* Reflectors implement Restorer to copy a reflection back out.
+Restore() returns a line describing each action taken (or with
+DryRun set, each action that would be taken) */
+type Restorer interface {
+  Restore(context.Context, RestoreOptions) ([]string, error)
 }
 
 type Generator interface {
   Reflect(ReflectorCode, string, string) (Reflector, error)
 }
 
+/* RetentionPolicy decides which snapshots survive pruning. The
+newest KeepLast snapshots are kept along with the newest snapshot
+in each of the last Hourly hours, Daily days, Weekly weeks and
+Monthly months. If MaxSize is set the oldest of those are then
+dropped until the snapshots fit in MaxSize bytes. The newest
+snapshot is never pruned and a zero policy keeps everything */
+type RetentionPolicy struct {
+  KeepLast int `json:"keep_last,omitempty"`
+  Hourly int `json:"hourly,omitempty"`
+  Daily int `json:"daily,omitempty"`
+  Weekly int `json:"weekly,omitempty"`
+  Monthly int `json:"monthly,omitempty"`
+  MaxSize int64 `json:"max_size,omitempty"`
+}
+
+func (r RetentionPolicy) IsZero() bool {
+  return r == RetentionPolicy{}
+}
+
+/* SettlePolicy decides how long backups of changed roots wait for
+writes to settle. A backup starts once the root has been quiet for
+Quiet or changes have kept coming for MaxDelay since the first one.
+Zero fields use the daemon's defaults */
+type SettlePolicy struct {
+  Quiet time.Duration `json:"quiet,omitempty"`
+  MaxDelay time.Duration `json:"max_delay,omitempty"`
+}
+
+func (s SettlePolicy) IsZero() bool {
+  return s == SettlePolicy{}
+}
+
 type MDBRow struct {
-  OriginalRoot string
-  ReflectionRoot string
-  ReflectionBase string
-  ReflectionCode ReflectorCode
-  DriveLabel string
-  HasChanged bool
+  OriginalRoot string `json:"original_root"`
+  ReflectionRoot string `json:"reflection_root"`
+  ReflectionBase string `json:"reflection_base"`
+  ReflectionCode ReflectorCode `json:"reflection_code"`
+  DriveLabel string `json:"drive_label"`
+  HasChanged bool `json:"has_changed"`
+  Retention RetentionPolicy `json:"retention"`
+  Settle SettlePolicy `json:"settle"`
+  Detection DetectionMode `json:"detection,omitempty"`
+  Changes ChangeSet `json:"changes"`
+  OwnerUID uint32 `json:"owner_uid,omitempty"`
+  OwnerGID uint32 `json:"owner_gid,omitempty"`
+  Paused bool `json:"paused,omitempty"`
+}
+
+// RunRecord describes a single backup run of an original root
+type RunRecord struct {
+  OriginalRoot string `json:"original_root"`
+  Start time.Time `json:"start"`
+  End time.Time `json:"end"`
+  Trigger BackupTrigger `json:"trigger"`
+  FilesCopied int `json:"files_copied"`
+  BytesCopied int64 `json:"bytes_copied"`
+  Error string `json:"error,omitempty"`
+}
+
+/* BackupStatus is what list and status report about a backup.
+Mounted is set when the reflection's drive is currently mounted
+and LastSuccess is the end of the most recent successful run. Job
+is the running or else the oldest queued backup of the root */
+type BackupStatus struct {
+  MDBRow
+  Mounted bool `json:"mounted"`
+  Paused bool `json:"paused"`
+  Job *Job `json:"job,omitempty"`
+  LastSuccess *time.Time `json:"last_success,omitempty"`
+  LastRun *RunRecord `json:"last_run,omitempty"`
 }
 
 type MetadataDB interface {
@@ -31,4 +209,6 @@ type MetadataDB interface {
   DeleteRow(string) (MDBRow, error)
   InsertRow(MDBRow) error
   UpdateRow(MDBRow) error
+  AddRun(RunRecord) error
+  Runs(string) ([]RunRecord, error)
 }
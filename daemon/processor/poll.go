@@ -0,0 +1,128 @@
+package processor
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "syscall"
+  "time"
+)
+
+// How often polled roots are scanned for changes
+var ScanInterval time.Duration = 30 * time.Second
+
+func validateDetection(mode DetectionMode) error {
+  switch mode {
+    case "", AutoDetection, PollDetection:
+      return nil
+  }
+  return fmt.Errorf("Unknown change detection %s", mode)
+}
+
+// fileState is what a pollScanner remembers about each path
+type fileState struct {
+  size int64
+  modTime time.Time
+  inode uint64
+  isDir bool
+}
+
+/* pollScanner finds the changes below a root without inotify by
+walking it every ScanInterval and comparing each path against what
+the previous walk saw. Changes are sent in batches until Stop() */
+type pollScanner struct {
+  root string
+  interval time.Duration
+  snapshot map[string]fileState
+  stop chan struct{}
+}
+
+// newPollScanner() takes the first snapshot of root
+func newPollScanner(root string) (*pollScanner, error) {
+  if _, err := os.Stat(root); err != nil {
+    return nil, fmt.Errorf("Couldn't stat %s in newPollScanner(): %v", root, err)
+  }
+  return &pollScanner{
+    root: root,
+    interval: ScanInterval,
+    snapshot: takeSnapshot(root),
+    stop: make(chan struct{}),
+  }, nil
+}
+
+func (p *pollScanner) run(out chan<- []Change) {
+  ticker := time.NewTicker(p.interval)
+  defer ticker.Stop()
+  for {
+    select {
+      case <-ticker.C:
+      case <-p.stop:
+        return
+    }
+
+    changes := p.scan()
+    if len(changes) == 0 {
+      continue
+    }
+    select {
+      case out<-changes:
+      case <-p.stop:
+        return
+    }
+  }
+}
+
+func (p *pollScanner) Stop() {
+  close(p.stop)
+}
+
+/* scan() takes a new snapshot of the root and returns how it
+differs from the last one. A path whose inode changed was replaced
+and counts as written. A root that vanished is reported as a change
+without a path */
+func (p *pollScanner) scan() []Change {
+  changes := make([]Change, 0)
+  if _, err := os.Stat(p.root); err != nil {
+    if len(p.snapshot) > 0 {
+      changes = append(changes, Change{Root: p.root, Op: RemoveOp})
+    }
+    p.snapshot = make(map[string]fileState)
+    return changes
+  }
+
+  snapshot := takeSnapshot(p.root)
+  for path, state := range snapshot {
+    old, ok := p.snapshot[path]
+    if !ok {
+      changes = append(changes, Change{Root: p.root, Path: path, Op: CreateOp})
+    } else if state != old && !(state.isDir && old.isDir && state.inode == old.inode) {
+      // Directories only count when replaced as their own entries report the rest
+      changes = append(changes, Change{Root: p.root, Path: path, Op: WriteOp})
+    }
+  }
+  for path := range p.snapshot {
+    if _, ok := snapshot[path]; !ok {
+      changes = append(changes, Change{Root: p.root, Path: path, Op: RemoveOp})
+    }
+  }
+  p.snapshot = snapshot
+  return changes
+}
+
+/* takeSnapshot() records the state of everything below root.
+Unreadable entries are left out */
+func takeSnapshot(root string) map[string]fileState {
+  snapshot := make(map[string]fileState)
+  filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+    if err != nil || path == root {
+      return nil
+    }
+    state := fileState{size: fi.Size(), modTime: fi.ModTime(), isDir: fi.IsDir()}
+    if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+      state.inode = uint64(st.Ino)
+    }
+    snapshot[path] = state
+    return nil
+  })
+  return snapshot
+}
@@ -1,7 +1,14 @@
 package processor
 
 import (
+  "encoding/json"
+  "context"
+  "path/filepath"
+  "strconv"
   "strings"
+  "sort"
+  "sync"
+  "time"
   "log"
   "fmt"
 )
@@ -12,109 +19,347 @@ const (
   BackupCommand CommandCode = "bak"
   NewBackupCommand = "n_bak"
   UnbackupCommand = "u_bak"
+  RetentionCommand = "ret"
+  SettleCommand = "stl"
+  DetectionCommand = "det"
+  PruneCommand = "prn"
+  RestoreCommand = "rst"
+  HistoryCommand = "hst"
+  ListCommand = "lst"
+  StatusCommand = "sts"
+  JobCommand = "job"
+  CancelCommand = "cnl"
+  PauseCommand = "pau"
+  ResumeCommand = "rsm"
+  SubscribeCommand = "sub"
 )
 
-func CommandProcessor(gen Generator, mdb MetadataDB, comChan chan string, updateChan <-chan string) {
+/* CommandProcessor() executes requests from the system on
+updateChan and calls from clients on comChan. Every call is
+answered on its own reply channel so responses can't be read
+by another client. Backups are handed to queue so they never
+hold up other commands. Roots being added and removed are published
+on events and clients may subscribe to everything published there */
+func CommandProcessor(gen Generator, mdb MetadataDB, queue *JobQueue, events *EventBus, comChan <-chan Call, updateChan <-chan Request) {
+  restorePauses(mdb, queue)
   for {
     select {
-      case cmd, ok := <-updateChan:
+      case req, ok := <-updateChan:
         if !ok {
           return
         }
-        if err := executeCommand(cmd, gen, mdb); err != nil {
+        if _, err := executeRequest(req, nil, gen, mdb, queue, events); err != nil {
           log.Printf("Failed to execute command in CommandProcessor: %v\n", err)
         }
-      case cmd, ok := <-comChan:
+      case call, ok := <-comChan:
         if !ok {
           return
         }
-        if err := executeCommand(cmd, gen, mdb); err != nil {
-          log.Printf("Failed to execute command(%s) in CommandProcessor: %v\n", cmd, err)
-          comChan<-FailCode
-        } else {
-          comChan<-SuccessCode
-        }
+        handleCall(call, gen, mdb, queue, events)
     }
   }
 }
 
-/* Command format: command_code:param1,param2,... */
-func executeCommand(cmd string, gen Generator, mdb MetadataDB) error {
-  cmdComponents := strings.Split(cmd, ":")
-  if len(cmdComponents) < 2 {
-    return fmt.Errorf("Invalid command input(%s) in executeCommand()", cmd)
+func handleCall(call Call, gen Generator, mdb MetadataDB, queue *JobQueue, events *EventBus) {
+  req, legacy, err := DecodeRequest(call.Message)
+  if err != nil {
+    log.Printf("Failed to decode message(%s) in CommandProcessor: %v\n", call.Message, err)
+    call.Reply<-encodeResponse(req, legacy, nil, classify(InvalidRequestError, err))
+    close(call.Reply)
+    return
+  }
+  if err = authorize(req, call.Peer, mdb, queue); err != nil {
+    log.Printf("Refused command(%s) from uid %d in CommandProcessor: %v\n", req.Command, call.Peer.UID, err)
+    call.Reply<-encodeResponse(req, legacy, nil, err)
+    close(call.Reply)
+    return
+  }
+
+  if req.Command == SubscribeCommand {
+    if legacy {
+      call.Reply<-encodeResponse(req, legacy, nil, newError(InvalidRequestError, "Subscriptions need a JSON request"))
+      close(call.Reply)
+      return
+    }
+    go subscribe(call, req, events)
+    return
+  }
+
+  respond := func() {
+    defer close(call.Reply)
+    result, err := executeRequest(req, call.Peer, gen, mdb, queue, events)
+    if err != nil {
+      log.Printf("Failed to execute command(%s) in CommandProcessor: %v\n", req.Command, err)
+    }
+    call.Reply<-encodeResponse(req, legacy, result, err)
+  }
+  // These may wait on a job in the queue for a long time
+  if req.Command == JobCommand || req.Command == CancelCommand || req.Command == RestoreCommand ||
+    req.Command == UnbackupCommand || req.Command == PruneCommand {
+    go respond()
+  } else {
+    respond()
   }
-  cmdType := CommandCode(cmdComponents[0])
-  params := strings.Split(cmdComponents[1], ",")
+}
+
+/* subscribe() acknowledges a subscription and then sends every
+event as a line of JSON until the client hangs up */
+func subscribe(call Call, req Request, events *EventBus) {
+  defer close(call.Reply)
+  sub := events.Subscribe()
+  defer events.Unsubscribe(sub)
+
+  line := encodeResponse(req, false, nil, nil)
+  for {
+    select {
+      case call.Reply<-line:
+      case <-call.Hangup:
+        return
+    }
+
+    select {
+      case event := <-sub:
+        serial, err := json.Marshal(event)
+        if err != nil {
+          log.Printf("Failed to encode event in subscribe(): %v", err)
+          return
+        }
+        line = string(serial)
+      case <-call.Hangup:
+        return
+    }
+  }
+}
+
+/* executeRequest() decodes the arguments of a request from peer and
+runs the command. The result is sent back to the client */
+func executeRequest(req Request, peer *Peer, gen Generator, mdb MetadataDB, queue *JobQueue, events *EventBus) (interface{}, error) {
+  var result interface{}
   var err error
 
-  switch cmdType {
+  switch req.Command {
     case BackupCommand:
-      err = backupCommand(params, gen, mdb)
+      var args BackupArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = backupCommand(args, gen, mdb, queue)
+      }
     case NewBackupCommand:
-      err = newBackupCommand(params, gen, mdb)
+      var args NewBackupArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = newBackupCommand(args, peer, gen, mdb, queue, events)
+      }
     case UnbackupCommand:
-      err = unbackupCommand(params, gen, mdb)
+      var args RootArgs
+      if err = decodeArgs(req, &args); err == nil {
+        err = unbackupCommand(args, gen, mdb, queue, events)
+      }
+    case RetentionCommand:
+      var args RetentionArgs
+      if err = decodeArgs(req, &args); err == nil {
+        err = retentionCommand(args, gen, mdb)
+      }
+    case SettleCommand:
+      var args SettleArgs
+      if err = decodeArgs(req, &args); err == nil {
+        err = settleCommand(args, gen, mdb)
+      }
+    case DetectionCommand:
+      var args DetectionArgs
+      if err = decodeArgs(req, &args); err == nil {
+        err = detectionCommand(args, gen, mdb)
+      }
+    case PruneCommand:
+      var args PruneArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = pruneCommand(args, gen, mdb, queue)
+      }
+    case RestoreCommand:
+      var args RestoreArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = restoreCommand(args, peer, gen, mdb, queue)
+      }
+    case HistoryCommand:
+      var args RootArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = historyCommand(args, gen, mdb)
+      }
+    case ListCommand:
+      result, err = listCommand(gen, mdb, queue)
+    case StatusCommand:
+      var args RootArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = statusCommand(args, gen, mdb, queue)
+      }
+    case JobCommand:
+      var args JobArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = jobCommand(args, queue)
+      }
+    case CancelCommand:
+      var args CancelArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = cancelCommand(args, queue)
+      }
+    case PauseCommand:
+      var args RootArgs
+      if err = decodeArgs(req, &args); err == nil {
+        err = pauseCommand(args, mdb, queue)
+      }
+    case ResumeCommand:
+      var args RootArgs
+      if err = decodeArgs(req, &args); err == nil {
+        result, err = resumeCommand(args, gen, mdb, queue)
+      }
     default:
-      return fmt.Errorf("Unknown command(%s) in executeCommand()", cmd)
+      return nil, newError(UnknownCommandError, "Unknown command(%s)", req.Command)
   }
 
   if err != nil {
-    return fmt.Errorf("Couldn't process command in executeCommand(): %v", err)
+    return nil, fmt.Errorf("Couldn't process command in executeRequest(): %w", err)
+  }
+  return result, nil
+}
+
+func decodeArgs(req Request, args interface{}) error {
+  if len(req.Args) == 0 {
+    return nil
+  }
+  if err := json.Unmarshal(req.Args, args); err != nil {
+    return newError(InvalidRequestError, "Invalid arguments for %s: %v", req.Command, err)
   }
   return nil
 }
 
-func backupCommand(params []string, gen Generator, mdb MetadataDB) error {
-  if len(params) < 1 {
-    return fmt.Errorf("Not enough params in backupCommand()")
+/* An empty trigger defaults to a manual backup. Forced backups
+run even when nothing has changed and fail if the drive isn't
+mounted. A forced backup with an empty root backs up every root.
+Unforced backups of paused roots are left for resumeCommand().
+Returns the queued job of each backup */
+func backupCommand(args BackupArgs, gen Generator, mdb MetadataDB, queue *JobQueue) ([]Job, error) {
+  backupRoot, force := args.Root, args.Force
+  trigger := args.Trigger
+  if trigger == "" {
+    trigger = ManualTrigger
+  }
+
+  keys := []string{backupRoot}
+  if backupRoot == "" && force {
+    keys = mdb.Keys()
+    sort.Strings(keys)
+  } else if _, err := mdb.GetRow(backupRoot); err != nil && force {
+    // Forced backups come from users who may name any path inside a root
+    if backupRoot, err = findContainingRoot(backupRoot, mdb); err != nil {
+      return nil, fmt.Errorf("Unknown backup in backupCommand(): %w", err)
+    }
+    keys = []string{backupRoot}
+  }
+
+  jobs := make([]Job, 0, len(keys))
+  for _, key := range keys {
+    mdbRow, err := getRow(key, mdb)
+    if err != nil {
+      return nil, fmt.Errorf("Couldn't retrieve row in backupCommand(): %w", err)
+    }
+    if !force && (!mdbRow.HasChanged || mdbRow.ReflectionRoot == "" || queue.Paused(key)) {
+      continue
+    }
+    jobs = append(jobs, enqueueBackup(mdbRow, trigger, force, gen, mdb, queue))
+  }
+  return jobs, nil
+}
+
+func enqueueBackup(mdbRow MDBRow, trigger BackupTrigger, force bool, gen Generator, mdb MetadataDB, queue *JobQueue) Job {
+  root := mdbRow.OriginalRoot
+  return queue.Enqueue(root, jobDrive(mdbRow), trigger, force, func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error) {
+    return backupRootCommand(ctx, progress, root, trigger, force, gen, mdb)
+  })
+}
+
+// jobDrive() is the drive jobs of a row are serialized on
+func jobDrive(mdbRow MDBRow) string {
+  if mdbRow.DriveLabel != "" {
+    return mdbRow.DriveLabel
   }
-  backupRoot := params[0]
-  mdbRow, err := mdb.GetRow(backupRoot)
+  return mdbRow.ReflectionRoot
+}
+
+/* backupRootCommand() backs up a single root. No run is returned
+when an unforced backup has nothing to do. The change set of the root
+is taken before the backup starts so changes made while it runs
+trigger another backup. Unforced backups are limited to the changed
+paths by reflectors that can do so. Reflectors that can report their
+progress send it on progress */
+func backupRootCommand(ctx context.Context, progress chan<- BackupProgress, backupRoot string, trigger BackupTrigger, force bool, gen Generator, mdb MetadataDB) (*RunRecord, error) {
+  mdbRow, err := getRow(backupRoot, mdb)
   if err != nil {
-    return fmt.Errorf("Couldn't retrieve row in backupCommand(): %v", err)
+    return nil, fmt.Errorf("Couldn't retrieve row in backupRootCommand(): %w", err)
   }
 
-  if !mdbRow.HasChanged {
+  if !mdbRow.HasChanged && !force {
     log.Printf("No need to backup. Directory unchanged")
-    return nil
+    return nil, nil
   }
   if mdbRow.ReflectionRoot == "" {
+    if force {
+      return nil, newError(NotMountedError, "Device %s is not mounted in backupRootCommand()", mdbRow.DriveLabel)
+    }
     log.Printf("No need to backup. Device not mounted")
-    return nil
+    return nil, nil
   }
 
   reflector, err := gen.Reflect(mdbRow.ReflectionCode, mdbRow.OriginalRoot, mdbRow.ReflectionRoot)
   if err != nil {
-    return fmt.Errorf("Failed to create reflector in backupCommand(): %v", err)
+    return nil, fmt.Errorf("Failed to create reflector in backupRootCommand(): %w", err)
+  }
+  if reporter, ok := reflector.(ProgressReporter); ok {
+    reporter.ReportProgress(progress)
   }
-  err = reflector.Backup()
+  changes, err := takeChanges(backupRoot, mdb)
   if err != nil {
-    return fmt.Errorf("Failed to reflect in backupCommand(): %v", err)
+    return nil, fmt.Errorf("Failed to update row in backupRootCommand(): %w", err)
   }
-
-  mdbRow.HasChanged = false
-  err = mdb.UpdateRow(mdbRow)
+  if setter, ok := reflector.(ChangeSetter); ok && !force && !changes.Full {
+    setter.SetChanges(changes)
+  }
+  run, err := recordBackup(ctx, reflector, mdbRow, trigger, mdb)
   if err != nil {
-    return fmt.Errorf("Failed to update row in backupCommand(): %v", err)
+    // A forced backup went through the whole root so all of it is retried
+    if force {
+      changes = FullChangeSet()
+    }
+    if _, setErr := recordChanges(backupRoot, changes, mdb); setErr != nil {
+      log.Printf("Failed to mark %s as changed in backupRootCommand(): %v", backupRoot, setErr)
+    }
+    if ctx.Err() != nil {
+      return &run, fmt.Errorf("Backup canceled in backupRootCommand(): %w", classify(CanceledError, err))
+    }
+    return &run, fmt.Errorf("Failed to reflect in backupRootCommand(): %w", classify(CopyFailedError, err))
   }
-  return nil
+  applyRetention(reflector, mdbRow)
+  return &run, nil
 }
 
-func newBackupCommand(params []string, gen Generator, mdb MetadataDB) error {
-  if len(params) < 3 {
-    return fmt.Errorf("Not enough paramaters in newBackupCommand()")
+/* newBackupCommand() registers a new backup owned by peer and queues
+its first full copy. The job of that copy is returned */
+func newBackupCommand(args NewBackupArgs, peer *Peer, gen Generator, mdb MetadataDB, queue *JobQueue, events *EventBus) (Job, error) {
+  if args.Original == "" || args.Reflection == "" || args.Reflector == "" {
+    return Job{}, newError(InvalidRequestError, "Not enough paramaters in newBackupCommand()")
   }
-  origRoot, refRoot := params[0], params[1]
-  refCode := ReflectorCode(params[2])
-
-  reflector, err := gen.Reflect(refCode, origRoot, refRoot)
-  if err != nil {
-    return fmt.Errorf("Couldn't reflect in newBackupCommand(): %v", err)
+  origRoot, refRoot := args.Original, args.Reflection
+  refCode, policy := args.Reflector, args.Retention
+  if err := validateRetention(policy); err != nil {
+    return Job{}, fmt.Errorf("Invalid retention policy in newBackupCommand(): %w", classify(InvalidRequestError, err))
   }
-  err = reflector.Backup()
-  if err != nil {
-    return fmt.Errorf("Couldn't backup in newBackupCommand(): %v", err)
+  if err := validateSettle(args.Settle); err != nil {
+    return Job{}, fmt.Errorf("Invalid settle policy in newBackupCommand(): %w", classify(InvalidRequestError, err))
+  }
+  if err := validateDetection(args.Detection); err != nil {
+    return Job{}, fmt.Errorf("Invalid change detection in newBackupCommand(): %w", classify(InvalidRequestError, err))
+  }
+
+  // Checked now so a bad reflector code fails the command rather than the job
+  if _, err := gen.Reflect(refCode, origRoot, refRoot); err != nil {
+    return Job{}, fmt.Errorf("Couldn't reflect in newBackupCommand(): %w", classify(InvalidRequestError, err))
   }
 
   driveLabel, refBase := pathToLabel(refRoot)
@@ -125,24 +370,579 @@ func newBackupCommand(params []string, gen Generator, mdb MetadataDB) error {
     ReflectionCode: refCode,
     ReflectionBase: refBase,
     DriveLabel: driveLabel,
-    HasChanged: false,
+    HasChanged: true,
+    Retention: policy,
+    Settle: args.Settle,
+    Detection: args.Detection,
   }
-  err = mdb.InsertRow(mdbRow)
+  if peer != nil {
+    mdbRow.OwnerUID, mdbRow.OwnerGID = peer.UID, peer.GID
+  }
+  if err := mdb.InsertRow(mdbRow); err != nil {
+    return Job{}, fmt.Errorf("Couldnt insert row in newBackupCommand(): %w", err)
+  }
+  events.Publish(Event{Type: RootAddedEvent, Root: origRoot, Drive: driveLabel})
+  return enqueueBackup(mdbRow, ManualTrigger, true, gen, mdb, queue), nil
+}
+
+/* unbackupCommand() stops backing up a root. Its queued and running
+jobs are canceled first so none of them runs against a deleted row */
+func unbackupCommand(args RootArgs, gen Generator, mdb MetadataDB, queue *JobQueue, events *EventBus) error {
+  if args.Root == "" {
+    return newError(InvalidRequestError, "Not enough parameters in unbackupCommand()")
+  }
+
+  origRoot := args.Root
+  if _, err := getRow(origRoot, mdb); err != nil {
+    return fmt.Errorf("Couldn't retrieve row in unbackupCommand(): %w", err)
+  }
+  queue.CancelRoot(origRoot)
+  mdbRow, err := mdb.DeleteRow(origRoot)
   if err != nil {
-    fmt.Errorf("Couldnt insert row in newBackupCommand(): %v", err)
+    return fmt.Errorf("Failed to remove %s from database in unbackupCommand(): %w", origRoot, classify(CommandFailedError, err))
+  }
+  events.Publish(Event{Type: RootRemovedEvent, Root: origRoot, Drive: mdbRow.DriveLabel})
+  return nil
+}
+
+func retentionCommand(args RetentionArgs, gen Generator, mdb MetadataDB) error {
+  if _, err := getRow(args.Root, mdb); err != nil {
+    return fmt.Errorf("Couldn't retrieve row in retentionCommand(): %w", err)
+  }
+  if err := validateRetention(args.Retention); err != nil {
+    return fmt.Errorf("Invalid retention policy in retentionCommand(): %w", classify(InvalidRequestError, err))
   }
 
+  err := modifyRow(args.Root, mdb, func(mdbRow *MDBRow) {
+    mdbRow.Retention = args.Retention
+  })
+  if err != nil {
+    return fmt.Errorf("Failed to update row in retentionCommand(): %w", err)
+  }
   return nil
 }
 
-func unbackupCommand(params []string, gen Generator, mdb MetadataDB) error {
-  if len(params) < 1 {
-    return fmt.Errorf("Not enough parameters in unbackupCommand()")
+func settleCommand(args SettleArgs, gen Generator, mdb MetadataDB) error {
+  if _, err := getRow(args.Root, mdb); err != nil {
+    return fmt.Errorf("Couldn't retrieve row in settleCommand(): %w", err)
+  }
+  if err := validateSettle(args.Settle); err != nil {
+    return fmt.Errorf("Invalid settle policy in settleCommand(): %w", classify(InvalidRequestError, err))
   }
 
-  origRoot := params[0]
-  if _, err := mdb.DeleteRow(origRoot); err != nil {
-    return fmt.Errorf("Failed to remove %s for database in unbackupCommand(): %v", origRoot, err)
+  err := modifyRow(args.Root, mdb, func(mdbRow *MDBRow) {
+    mdbRow.Settle = args.Settle
+  })
+  if err != nil {
+    return fmt.Errorf("Failed to update row in settleCommand(): %w", err)
   }
   return nil
 }
+
+/* detectionCommand() chooses how changes to a root are detected.
+The monitor picks up the new mode the next time it polls the roots */
+func detectionCommand(args DetectionArgs, gen Generator, mdb MetadataDB) error {
+  if _, err := getRow(args.Root, mdb); err != nil {
+    return fmt.Errorf("Couldn't retrieve row in detectionCommand(): %w", err)
+  }
+  if err := validateDetection(args.Detection); err != nil {
+    return fmt.Errorf("Invalid change detection in detectionCommand(): %w", classify(InvalidRequestError, err))
+  }
+
+  err := modifyRow(args.Root, mdb, func(mdbRow *MDBRow) {
+    mdbRow.Detection = args.Detection
+  })
+  if err != nil {
+    return fmt.Errorf("Failed to update row in detectionCommand(): %w", err)
+  }
+  return nil
+}
+
+/* The prune runs in a job on the drive of the reflection so it never
+removes snapshots while a backup or restore uses that drive. Returns
+every snapshot that was (or would be) pruned once the job is done */
+func pruneCommand(args PruneArgs, gen Generator, mdb MetadataDB, queue *JobQueue) ([]string, error) {
+  mdbRow, err := getRow(args.Root, mdb)
+  if err != nil {
+    return nil, fmt.Errorf("Couldn't retrieve row in pruneCommand(): %w", err)
+  }
+  if mdbRow.ReflectionRoot == "" {
+    return nil, newError(NotMountedError, "Device for %s is not mounted in pruneCommand()", mdbRow.OriginalRoot)
+  }
+
+  reflector, err := gen.Reflect(mdbRow.ReflectionCode, mdbRow.OriginalRoot, mdbRow.ReflectionRoot)
+  if err != nil {
+    return nil, fmt.Errorf("Failed to create reflector in pruneCommand(): %w", err)
+  }
+  pruner, ok := reflector.(Pruner)
+  if !ok {
+    return nil, newError(InvalidRequestError, "Reflector %s does not keep snapshots in pruneCommand()", mdbRow.ReflectionCode)
+  }
+
+  var pruned []string
+  job := queue.EnqueuePrune(mdbRow.OriginalRoot, jobDrive(mdbRow), func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error) {
+    var err error
+    if err = ctx.Err(); err == nil {
+      err = runAs(mdbRow.OwnerUID, mdbRow.OwnerGID, func() (err error) {
+        pruned, err = pruner.Prune(mdbRow.Retention, args.DryRun)
+        return err
+      })
+    }
+    if err != nil {
+      return nil, fmt.Errorf("Failed to prune in pruneCommand(): %w", err)
+    }
+    return nil, nil
+  })
+  if job, err = queue.Wait(job.ID); err != nil {
+    return nil, fmt.Errorf("Lost prune job in pruneCommand(): %w", err)
+  }
+  if job.Error != nil {
+    return nil, job.Error
+  }
+  return pruned, nil
+}
+
+/* An empty target restores over the original root. The path may
+be absolute or relative to the original root and limits the restore
+to that file or directory. When the original root is empty it is
+whichever backup root contains the path. The time picks the newest
+snapshot taken before it when no snapshot is named. The restore runs
+as peer in a job on the drive of the reflection so it waits for
+backups to that drive. Returns every restore action taken once the
+job is done */
+func restoreCommand(args RestoreArgs, peer *Peer, gen Generator, mdb MetadataDB, queue *JobQueue) ([]string, error) {
+  var err error
+  origRoot, path := args.Root, args.Path
+  switch args.Policy {
+    case OverwriteConflicts, SkipConflicts, KeepBothConflicts:
+    default:
+      return nil, newError(InvalidRequestError, "Unknown conflict policy %s in restoreCommand()", args.Policy)
+  }
+  if origRoot == "" {
+    if origRoot, err = findContainingRoot(path, mdb); err != nil {
+      return nil, fmt.Errorf("Couldn't resolve path in restoreCommand(): %w", err)
+    }
+  }
+  if filepath.IsAbs(path) {
+    if path, err = filepath.Rel(origRoot, path); err != nil {
+      return nil, fmt.Errorf("Couldn't resolve path in restoreCommand(): %w", err)
+    }
+  }
+
+  mdbRow, err := getRow(origRoot, mdb)
+  if err != nil {
+    return nil, fmt.Errorf("Couldn't retrieve row in restoreCommand(): %w", err)
+  }
+  refRoot, err := locateReflection(mdbRow)
+  if err != nil {
+    return nil, fmt.Errorf("Couldn't locate reflection in restoreCommand(): %w", err)
+  }
+
+  reflector, err := gen.Reflect(mdbRow.ReflectionCode, mdbRow.OriginalRoot, refRoot)
+  if err != nil {
+    return nil, fmt.Errorf("Failed to create reflector in restoreCommand(): %w", err)
+  }
+  restorer, ok := reflector.(Restorer)
+  if !ok {
+    return nil, newError(InvalidRequestError, "Reflector %s can't restore in restoreCommand()", mdbRow.ReflectionCode)
+  }
+
+  opts := RestoreOptions{
+    Target: args.Target,
+    Path: path,
+    Snapshot: args.Snapshot,
+    At: args.At,
+    Policy: args.Policy,
+    DryRun: args.DryRun,
+  }
+  if opts.Target == "" {
+    opts.Target = mdbRow.OriginalRoot
+  }
+
+  var uid, gid uint32
+  if peer != nil {
+    uid, gid = peer.UID, peer.GID
+  }
+  var actions []string
+  job := queue.EnqueueRestore(mdbRow.OriginalRoot, jobDrive(mdbRow), func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error) {
+    var err error
+    if err = ctx.Err(); err == nil {
+      err = runAs(uid, gid, func() (err error) {
+        actions, err = restorer.Restore(ctx, opts)
+        return err
+      })
+    }
+    if err != nil {
+      return nil, fmt.Errorf("Failed to restore in restoreCommand(): %w", classify(CopyFailedError, err))
+    }
+    return nil, nil
+  })
+  if job, err = queue.Wait(job.ID); err != nil {
+    return nil, fmt.Errorf("Lost restore job in restoreCommand(): %w", err)
+  }
+  if job.Error != nil {
+    return nil, job.Error
+  }
+  return actions, nil
+}
+
+/* rowMutex is held while a row is read, modified and written back
+so goroutines updating different fields of a row can't undo each
+other's changes */
+var rowMutex sync.Mutex
+
+// modifyRow() applies modify to the row of root and writes it back
+func modifyRow(root string, mdb MetadataDB, modify func(*MDBRow)) error {
+  rowMutex.Lock()
+  defer rowMutex.Unlock()
+
+  mdbRow, err := mdb.GetRow(root)
+  if err != nil {
+    return err
+  }
+  modify(&mdbRow)
+  return mdb.UpdateRow(mdbRow)
+}
+
+// getRow() is mdb.GetRow() with a missing row reported as an unknown root
+func getRow(root string, mdb MetadataDB) (MDBRow, error) {
+  mdbRow, err := mdb.GetRow(root)
+  if err != nil {
+    return MDBRow{}, classify(UnknownRootError, err)
+  }
+  return mdbRow, nil
+}
+
+/* jobCommand() returns the job with the given id, waiting for it
+to finish if asked to. An empty id returns every job */
+func jobCommand(args JobArgs, queue *JobQueue) ([]Job, error) {
+  if args.ID == "" {
+    return queue.Jobs(), nil
+  }
+
+  var job Job
+  var err error
+  if args.Wait {
+    job, err = queue.Wait(args.ID)
+  } else {
+    job, err = queue.Get(args.ID)
+  }
+  if err != nil {
+    return nil, fmt.Errorf("Couldn't find job in jobCommand(): %w", err)
+  }
+  return []Job{job}, nil
+}
+
+// Returns every job that was canceled once it has stopped
+func cancelCommand(args CancelArgs, queue *JobQueue) ([]Job, error) {
+  if args.ID == "" {
+    return queue.CancelRoot(args.Root), nil
+  }
+  job, err := queue.Cancel(args.ID)
+  if err != nil {
+    return nil, fmt.Errorf("Couldn't cancel job in cancelCommand(): %w", err)
+  }
+  return []Job{job}, nil
+}
+
+/* pauseCommand() stops changes and mounts from triggering backups
+of the root containing the given path or of every root when the
+path is empty */
+func pauseCommand(args RootArgs, mdb MetadataDB, queue *JobQueue) error {
+  root, err := resolveRoot(args.Root, mdb)
+  if err != nil {
+    return fmt.Errorf("Unknown backup in pauseCommand(): %w", err)
+  }
+  if err = setPaused(root, true, mdb); err != nil {
+    return fmt.Errorf("Failed to remember pause in pauseCommand(): %w", classify(CommandFailedError, err))
+  }
+  queue.Pause(root)
+  return nil
+}
+
+/* resumeCommand() undoes pauseCommand() and queues a backup of
+every resumed root that changed while it was paused */
+func resumeCommand(args RootArgs, gen Generator, mdb MetadataDB, queue *JobQueue) ([]Job, error) {
+  root, err := resolveRoot(args.Root, mdb)
+  if err != nil {
+    return nil, fmt.Errorf("Unknown backup in resumeCommand(): %w", err)
+  }
+  if err = setPaused(root, false, mdb); err != nil {
+    return nil, fmt.Errorf("Failed to forget pause in resumeCommand(): %w", classify(CommandFailedError, err))
+  }
+  queue.Resume(root)
+
+  keys := []string{root}
+  if root == "" {
+    keys = mdb.Keys()
+    sort.Strings(keys)
+  }
+  jobs := make([]Job, 0)
+  for _, key := range keys {
+    catchUp, err := backupCommand(BackupArgs{Root: key, Trigger: ChangeTrigger}, gen, mdb, queue)
+    if err != nil {
+      return jobs, fmt.Errorf("Couldn't catch up on %s in resumeCommand(): %w", key, err)
+    }
+    jobs = append(jobs, catchUp...)
+  }
+  return jobs, nil
+}
+
+/* setPaused() records in the row of root, or of every root when
+root is empty, whether it is paused so pauses outlive the daemon */
+func setPaused(root string, paused bool, mdb MetadataDB) error {
+  keys := []string{root}
+  if root == "" {
+    keys = mdb.Keys()
+  }
+  for _, key := range keys {
+    err := modifyRow(key, mdb, func(mdbRow *MDBRow) {
+      mdbRow.Paused = paused
+    })
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// restorePauses() pauses every root that was paused when the daemon stopped
+func restorePauses(mdb MetadataDB, queue *JobQueue) {
+  for _, key := range mdb.Keys() {
+    if mdbRow, err := mdb.GetRow(key); err == nil && mdbRow.Paused {
+      queue.Pause(key)
+    }
+  }
+}
+
+/* resolveRoot() returns the backup root containing path. An empty
+path stays empty */
+func resolveRoot(path string, mdb MetadataDB) (string, error) {
+  if path == "" {
+    return "", nil
+  }
+  if _, err := mdb.GetRow(path); err == nil {
+    return path, nil
+  }
+  return findContainingRoot(path, mdb)
+}
+
+/* findContainingRoot() returns the backup root that contains
+path. With nested backup roots the deepest one wins */
+func findContainingRoot(path string, mdb MetadataDB) (string, error) {
+  path = filepath.Clean(path)
+  found, foundLen := "", -1
+  for _, key := range mdb.Keys() {
+    root := filepath.Clean(key)
+    if path != root && !strings.HasPrefix(path, root+string(filepath.Separator)) && root != "/" {
+      continue
+    }
+    if len(root) > foundLen {
+      found, foundLen = key, len(root)
+    }
+  }
+
+  if foundLen < 0 {
+    return "", newError(UnknownRootError, "%s is not inside any backed up directory", path)
+  }
+  return found, nil
+}
+
+/* locateReflection() finds where a reflection currently lives
+by looking up wherever its drive is mounted right now. Rows
+without a drive label fall back to the last known location */
+func locateReflection(mdbRow MDBRow) (string, error) {
+  if mdbRow.DriveLabel == "" {
+    if mdbRow.ReflectionRoot == "" {
+      return "", newError(NotMountedError, "No known location for reflection of %s", mdbRow.OriginalRoot)
+    }
+    return mdbRow.ReflectionRoot, nil
+  }
+
+  mountPoint := labelToMountPoint(mdbRow.DriveLabel)
+  if mountPoint == "" {
+    return "", newError(NotMountedError, "Drive %s is not mounted", mdbRow.DriveLabel)
+  }
+  return filepath.Join(mountPoint, mdbRow.ReflectionBase), nil
+}
+
+/* recordBackup() runs a backup as the owner of mdbRow and adds
+the outcome to the run history of its root whether it succeeds or not */
+func recordBackup(ctx context.Context, reflector Reflector, mdbRow MDBRow, trigger BackupTrigger, mdb MetadataDB) (RunRecord, error) {
+  run := RunRecord{
+    OriginalRoot: mdbRow.OriginalRoot,
+    Start: time.Now(),
+    Trigger: trigger,
+  }
+  err := runAs(mdbRow.OwnerUID, mdbRow.OwnerGID, func() error {
+    return reflector.Backup(ctx)
+  })
+  run.End = time.Now()
+
+  if reporter, ok := reflector.(StatsReporter); ok {
+    stats := reporter.Stats()
+    run.FilesCopied = stats.FilesCopied
+    run.BytesCopied = stats.BytesCopied
+  }
+  if err != nil {
+    run.Error = err.Error()
+  }
+  if histErr := mdb.AddRun(run); histErr != nil {
+    log.Printf("Failed to record run in recordBackup(): %v", histErr)
+  }
+  return run, err
+}
+
+/* The root may be any path inside a backup root. Returns the
+run history from oldest to newest. An empty root returns the
+history of every backup */
+func historyCommand(args RootArgs, gen Generator, mdb MetadataDB) ([]RunRecord, error) {
+  keys := mdb.Keys()
+  if args.Root != "" {
+    root := args.Root
+    if _, err := mdb.GetRow(root); err != nil {
+      if root, err = findContainingRoot(root, mdb); err != nil {
+        return nil, fmt.Errorf("Unknown backup in historyCommand(): %w", err)
+      }
+    }
+    keys = []string{root}
+  }
+
+  runs := make([]RunRecord, 0)
+  for _, key := range keys {
+    keyRuns, err := mdb.Runs(key)
+    if err != nil {
+      return nil, fmt.Errorf("Failed to retrieve runs of %s in historyCommand(): %w", key, err)
+    }
+    runs = append(runs, keyRuns...)
+  }
+  sort.Slice(runs, func(i, j int) bool {
+    return runs[i].Start.Before(runs[j].Start)
+  })
+  return runs, nil
+}
+
+// Returns the status of every backup sorted by original root
+func listCommand(gen Generator, mdb MetadataDB, queue *JobQueue) ([]BackupStatus, error) {
+  keys := mdb.Keys()
+  sort.Strings(keys)
+  return backupStatuses(keys, mdb, queue)
+}
+
+/* The root may be any path inside a backup root. Returns the
+same as listCommand() but limited to that root */
+func statusCommand(args RootArgs, gen Generator, mdb MetadataDB, queue *JobQueue) ([]BackupStatus, error) {
+  if args.Root == "" {
+    return listCommand(gen, mdb, queue)
+  }
+
+  root := args.Root
+  if _, err := mdb.GetRow(root); err != nil {
+    if root, err = findContainingRoot(root, mdb); err != nil {
+      return nil, fmt.Errorf("Unknown backup in statusCommand(): %w", err)
+    }
+  }
+  return backupStatuses([]string{root}, mdb, queue)
+}
+
+func backupStatuses(keys []string, mdb MetadataDB, queue *JobQueue) ([]BackupStatus, error) {
+  statuses := make([]BackupStatus, 0, len(keys))
+  for _, key := range keys {
+    mdbRow, err := getRow(key, mdb)
+    if err != nil {
+      return nil, fmt.Errorf("Couldn't retrieve row in backupStatuses(): %w", err)
+    }
+    runs, err := mdb.Runs(key)
+    if err != nil {
+      return nil, fmt.Errorf("Couldn't retrieve runs in backupStatuses(): %w", err)
+    }
+
+    status := BackupStatus{
+      MDBRow: mdbRow,
+      Mounted: mdbRow.ReflectionRoot != "",
+      Paused: queue.Paused(key),
+    }
+    if job, ok := queue.Active(key); ok {
+      status.Job = &job
+    }
+    if len(runs) > 0 {
+      status.LastRun = &runs[len(runs) - 1]
+    }
+    for i := len(runs) - 1; i >= 0; i-- {
+      if runs[i].Error == "" {
+        status.LastSuccess = &runs[i].End
+        break
+      }
+    }
+    statuses = append(statuses, status)
+  }
+  return statuses, nil
+}
+
+/* applyRetention() prunes a reflection after a successful backup.
+Failing to prune doesn't fail the backup so errors are only logged */
+func applyRetention(reflector Reflector, mdbRow MDBRow) {
+  pruner, ok := reflector.(Pruner)
+  if !ok || mdbRow.Retention.IsZero() {
+    return
+  }
+
+  var pruned []string
+  err := runAs(mdbRow.OwnerUID, mdbRow.OwnerGID, func() (err error) {
+    pruned, err = pruner.Prune(mdbRow.Retention, false)
+    return err
+  })
+  if err != nil {
+    log.Printf("Failed to prune %s in applyRetention(): %v", mdbRow.ReflectionRoot, err)
+  }
+  for _, path := range pruned {
+    log.Printf("Pruned %s", path)
+  }
+}
+
+func ParseRetention(fields []string) (RetentionPolicy, error) {
+  if len(fields) < 6 {
+    return RetentionPolicy{}, fmt.Errorf("Expected 6 retention fields but got %d", len(fields))
+  }
+  counts := make([]int, 5)
+  for i := range counts {
+    count, err := strconv.Atoi(fields[i])
+    if err != nil || count < 0 {
+      return RetentionPolicy{}, fmt.Errorf("Invalid retention count %s", fields[i])
+    }
+    counts[i] = count
+  }
+  maxSize, err := strconv.ParseInt(fields[5], 10, 64)
+  if err != nil || maxSize < 0 {
+    return RetentionPolicy{}, fmt.Errorf("Invalid retention size %s", fields[5])
+  }
+
+  return RetentionPolicy{
+    KeepLast: counts[0],
+    Hourly: counts[1],
+    Daily: counts[2],
+    Weekly: counts[3],
+    Monthly: counts[4],
+    MaxSize: maxSize,
+  }, nil
+}
+
+func validateRetention(policy RetentionPolicy) error {
+  if policy.KeepLast < 0 || policy.Hourly < 0 || policy.Daily < 0 ||
+    policy.Weekly < 0 || policy.Monthly < 0 || policy.MaxSize < 0 {
+    return fmt.Errorf("Retention counts and size can't be negative")
+  }
+  return nil
+}
+
+// FormatRetention() turns a policy into the fields ParseRetention() reads
+func FormatRetention(policy RetentionPolicy) []string {
+  return []string{
+    strconv.Itoa(policy.KeepLast),
+    strconv.Itoa(policy.Hourly),
+    strconv.Itoa(policy.Daily),
+    strconv.Itoa(policy.Weekly),
+    strconv.Itoa(policy.Monthly),
+    strconv.FormatInt(policy.MaxSize, 10),
+  }
+}
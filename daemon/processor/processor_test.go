@@ -1,37 +1,41 @@
 package processor
 import (
+  "context"
   "fmt"
   "time"
   "testing"
-  "github.com/arstevens/goback/daemon/interactor"
-  "github.com/arstevens/goback/daemon/reflector"
-  "github.com/arstevens/goback/daemon/processor"
+  "io/ioutil"
+  "path/filepath"
+  "reflect"
+  "os"
+  "github.com/fsnotify/fsnotify"
 )
 
 type TestMDB struct {
-  db map[string]processor.MDBRow
+  db map[string]MDBRow
+  runs map[string][]RunRecord
 }
 
-func (mdb *TestMDB) GetRow(key string) (processor.MDBRow, error) {
+func (mdb *TestMDB) GetRow(key string) (MDBRow, error) {
   row, ok := mdb.db[key]
   if !ok {
-    return processor.MDBRow{}, fmt.Errorf("Unknown key %s in TestDB.GetRow()", key)
+    return MDBRow{}, fmt.Errorf("Unknown key %s in TestDB.GetRow()", key)
   }
   return row, nil
 }
 
-func (mdb *TestMDB) DeleteRow(key string) (processor.MDBRow, error) {
+func (mdb *TestMDB) DeleteRow(key string) (MDBRow, error) {
   row := mdb.db[key]
   delete(mdb.db, key)
   return row, nil
 }
 
-func (mdb *TestMDB) InsertRow(row processor.MDBRow) error {
+func (mdb *TestMDB) InsertRow(row MDBRow) error {
   mdb.db[row.OriginalRoot] = row
   return nil
 }
 
-func (mdb *TestMDB) UpdateRow(row processor.MDBRow) error {
+func (mdb *TestMDB) UpdateRow(row MDBRow) error {
   mdb.db[row.OriginalRoot] = row
   return nil
 }
@@ -44,6 +48,18 @@ func (mdb *TestMDB) Keys() []string {
   return keys
 }
 
+func (mdb *TestMDB) AddRun(run RunRecord) error {
+  if mdb.runs == nil {
+    mdb.runs = make(map[string][]RunRecord)
+  }
+  mdb.runs[run.OriginalRoot] = append(mdb.runs[run.OriginalRoot], run)
+  return nil
+}
+
+func (mdb *TestMDB) Runs(key string) ([]RunRecord, error) {
+  return mdb.runs[key], nil
+}
+
 func TestMonitorSystem(t *testing.T) {
 
 }
@@ -189,3 +205,751 @@ func TestDetector(t *testing.T) {
   fmt.Println(resp)
 }
 */
+
+func TestDetectorNewDirectories(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  NextChangeTimeout = 200 * time.Millisecond
+  d := newFsDetector()
+  defer d.Close()
+  if err = d.Watch(tmp); err != nil {
+    t.Fatal(err)
+  }
+
+  // Directories created after the watch are watched as well
+  sub := filepath.Join(tmp, "sub")
+  if err = os.Mkdir(sub, 0755); err != nil {
+    t.Fatal(err)
+  }
+  if change := expectChange(t, d, tmp); change.Path != sub || change.Op != CreateOp {
+    t.Errorf("Expected creation of %s but got %v", sub, change)
+  }
+  drainChanges(d)
+  writeDetectorFile(t, filepath.Join(sub, "a.txt"))
+  expectChange(t, d, tmp)
+  drainChanges(d)
+
+  // Files created before the watch on their directory lands count too
+  deep := filepath.Join(tmp, "x", "y", "z")
+  if err = os.MkdirAll(deep, 0755); err != nil {
+    t.Fatal(err)
+  }
+  writeDetectorFile(t, filepath.Join(deep, "b.txt"))
+  drainChanges(d)
+  if !d.watched[deep] {
+    t.Errorf("Expected %s to be watched", deep)
+  }
+  writeDetectorFile(t, filepath.Join(deep, "c.txt"))
+  expectChange(t, d, tmp)
+  drainChanges(d)
+
+  // Renamed and removed directories lose their watches
+  renamed := filepath.Join(tmp, "renamed")
+  if err = os.Rename(filepath.Join(tmp, "x"), renamed); err != nil {
+    t.Fatal(err)
+  }
+  if err = os.RemoveAll(sub); err != nil {
+    t.Fatal(err)
+  }
+  drainChanges(d)
+  for _, path := range []string{sub, deep, filepath.Join(tmp, "x")} {
+    if d.watched[path] {
+      t.Errorf("Expected %s to no longer be watched", path)
+    }
+  }
+  if !d.watched[filepath.Join(renamed, "y", "z")] {
+    t.Errorf("Expected the renamed directories to be watched")
+  }
+  writeDetectorFile(t, filepath.Join(renamed, "y", "z", "d.txt"))
+  expectChange(t, d, tmp)
+}
+
+func TestDetectorFilledDirectory(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  d := newFsDetector()
+  defer d.Close()
+  if err = d.Watch(tmp); err != nil {
+    t.Fatal(err)
+  }
+
+  // Fill a directory before the detector gets to see its creation
+  filled := filepath.Join(tmp, "filled")
+  if err = os.Mkdir(filled, 0755); err != nil {
+    t.Fatal(err)
+  }
+  writeDetectorFile(t, filepath.Join(filled, "a.txt"))
+  d.followEvent(fsnotify.Event{Name: filled, Op: fsnotify.Create})
+  expected := []Change{
+    Change{Root: tmp, Path: filled, Op: CreateOp},
+    Change{Root: tmp, Path: filepath.Join(filled, "a.txt"), Op: CreateOp},
+  }
+  if !reflect.DeepEqual(d.pending, expected) {
+    t.Errorf("Expected pending changes %v but got %v", expected, d.pending)
+  }
+
+  empty := filepath.Join(tmp, "empty")
+  if err = os.Mkdir(empty, 0755); err != nil {
+    t.Fatal(err)
+  }
+  d.pending = d.pending[:0]
+  d.followEvent(fsnotify.Event{Name: empty, Op: fsnotify.Create})
+  if len(d.pending) != 1 || d.pending[0].Path != empty {
+    t.Errorf("Expected only the change of the empty directory but got %v", d.pending)
+  }
+}
+
+func TestDetectorNestedRoots(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  outer := filepath.Join(tmp, "outer")
+  inner := filepath.Join(outer, "inner")
+  other := filepath.Join(tmp, "other")
+  for _, dir := range []string{inner, other} {
+    if err = os.MkdirAll(dir, 0755); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  NextChangeTimeout = 200 * time.Millisecond
+  d := newFsDetector()
+  defer d.Close()
+  for _, root := range []string{outer, inner, other} {
+    if err = d.Watch(root); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  // Changes belong to the innermost root containing them
+  writeDetectorFile(t, filepath.Join(inner, "a.txt"))
+  expectChange(t, d, inner)
+  drainChanges(d)
+  writeDetectorFile(t, filepath.Join(outer, "b.txt"))
+  expectChange(t, d, outer)
+  drainChanges(d)
+
+  // Removing a root doesn't mix up the roots left
+  if err = d.Unwatch(outer); err != nil {
+    t.Fatal(err)
+  }
+  if d.watched[outer] || !d.watched[inner] {
+    t.Errorf("Expected only the watches of the inner root to stay")
+  }
+  writeDetectorFile(t, filepath.Join(other, "c.txt"))
+  expectChange(t, d, other)
+  drainChanges(d)
+  writeDetectorFile(t, filepath.Join(inner, "d.txt"))
+  expectChange(t, d, inner)
+  drainChanges(d)
+
+  if err = d.Unwatch(inner); err != nil {
+    t.Fatal(err)
+  }
+  writeDetectorFile(t, filepath.Join(inner, "e.txt"))
+  if change, err := d.NextChange(); err == nil {
+    t.Errorf("Expected no changes of unwatched roots but got %v", change)
+  }
+}
+
+func TestDetectorOverflow(t *testing.T) {
+  d := newFsDetector()
+  d.roots["/a"], d.roots["/b"] = true, true
+  d.followError(fsnotify.ErrEventOverflow)
+  if len(d.pending) != 2 || d.pending[0].Path != "" || d.pending[1].Path != "" {
+    t.Errorf("Expected a change without a path for every root but got %v", d.pending)
+  }
+}
+
+func TestPollScanner(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  kept, written, removed := filepath.Join(tmp, "kept.txt"), filepath.Join(tmp, "written.txt"), filepath.Join(tmp, "removed.txt")
+  for _, path := range []string{kept, written, removed} {
+    writeDetectorFile(t, path)
+  }
+  p, err := newPollScanner(tmp)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if changes := p.scan(); len(changes) != 0 {
+    t.Errorf("Expected no changes without writes but got %v", changes)
+  }
+
+  if err = ioutil.WriteFile(written, []byte("longer than before"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  os.Remove(removed)
+  created := filepath.Join(tmp, "dir", "created.txt")
+  if err = os.Mkdir(filepath.Dir(created), 0755); err != nil {
+    t.Fatal(err)
+  }
+  writeDetectorFile(t, created)
+
+  set := NewChangeSet(tmp, p.scan())
+  expected := NewChangeSet(tmp, []Change{
+    Change{Root: tmp, Path: written, Op: WriteOp},
+    Change{Root: tmp, Path: removed, Op: RemoveOp},
+    Change{Root: tmp, Path: filepath.Dir(created), Op: CreateOp},
+    Change{Root: tmp, Path: created, Op: CreateOp},
+  })
+  if !reflect.DeepEqual(set, expected) {
+    t.Errorf("Expected changes %v but got %v", expected.Paths, set.Paths)
+  }
+
+  // A file replaced by another of the same size and time is still caught
+  fi, err := os.Stat(kept)
+  if err != nil {
+    t.Fatal(err)
+  }
+  replacement := filepath.Join(tmp, "replacement")
+  writeDetectorFile(t, replacement)
+  if err = ioutil.WriteFile(replacement, []byte(kept), 0644); err != nil {
+    t.Fatal(err)
+  }
+  os.Chtimes(replacement, fi.ModTime(), fi.ModTime())
+  p.scan()
+  if err = os.Rename(replacement, kept); err != nil {
+    t.Fatal(err)
+  }
+  set = NewChangeSet(tmp, p.scan())
+  if !set.Has("kept.txt", WriteOp) {
+    t.Errorf("Expected the replaced file to count as written but got %v", set.Paths)
+  }
+}
+
+func TestDetectorPoll(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  inner := filepath.Join(tmp, "inner")
+  if err = os.Mkdir(inner, 0755); err != nil {
+    t.Fatal(err)
+  }
+  defer func(interval time.Duration) { ScanInterval = interval }(ScanInterval)
+  ScanInterval = 50 * time.Millisecond
+  NextChangeTimeout = time.Second
+  d := newFsDetector()
+  defer d.Close()
+  if err = d.Poll(tmp); err != nil {
+    t.Fatal(err)
+  }
+  if err = d.Watch(inner); err != nil {
+    t.Fatal(err)
+  }
+
+  a := filepath.Join(tmp, "a.txt")
+  writeDetectorFile(t, a)
+  if change := expectChange(t, d, tmp); change.Path != a || change.Op != CreateOp {
+    t.Errorf("Expected creation of %s but got %v", a, change)
+  }
+
+  // Nested roots still win over the polled root around them
+  if err = d.Unwatch(tmp); err != nil {
+    t.Fatal(err)
+  }
+  if err = d.Poll(tmp); err != nil {
+    t.Fatal(err)
+  }
+  d.followScan([]Change{Change{Root: tmp, Path: filepath.Join(inner, "b.txt"), Op: CreateOp}})
+  expectChange(t, d, inner)
+
+  if err = d.Unwatch(tmp); err != nil {
+    t.Fatal(err)
+  }
+  d.followScan([]Change{Change{Root: tmp, Path: a, Op: WriteOp}})
+  if len(d.pending) != 0 {
+    t.Errorf("Expected scans of unwatched roots to be dropped but got %v", d.pending)
+  }
+}
+
+func TestChangeSet(t *testing.T) {
+  root := filepath.Join("/", "orig")
+  set := NewChangeSet(root, []Change{
+    Change{Root: root, Path: filepath.Join(root, "a.txt"), Op: WriteOp},
+    Change{Root: root, Path: filepath.Join(root, "a.txt"), Op: WriteOp},
+    Change{Root: root, Path: filepath.Join(root, "dir", "b.txt"), Op: CreateOp},
+  })
+  expected := ChangeSet{Paths: map[string][]ChangeOp{
+    "a.txt": []ChangeOp{WriteOp},
+    filepath.Join("dir", "b.txt"): []ChangeOp{CreateOp},
+  }}
+  if !reflect.DeepEqual(set, expected) {
+    t.Errorf("Expected %v but got %v", expected, set)
+  }
+
+  merged := set.Merge(NewChangeSet(root, []Change{Change{Root: root, Path: filepath.Join(root, "a.txt"), Op: RemoveOp}}))
+  if !merged.Has("a.txt", WriteOp) || !merged.Has("a.txt", RemoveOp) {
+    t.Errorf("Expected merged ops of a.txt but got %v", merged.Paths["a.txt"])
+  }
+  if set.Has("a.txt", RemoveOp) {
+    t.Errorf("Expected Merge() to leave the original set alone")
+  }
+
+  // Anything that can't be placed below root needs a full backup
+  for _, path := range []string{"", root, filepath.Join("/", "other", "c.txt")} {
+    if set := NewChangeSet(root, []Change{Change{Root: root, Path: path}}); !set.Full {
+      t.Errorf("Expected a change of %q to give a full change set", path)
+    }
+  }
+
+  defer func(max int) { MaxChangeSetPaths = max }(MaxChangeSetPaths)
+  MaxChangeSetPaths = 1
+  if !set.Merge(ChangeSet{}).Full {
+    t.Errorf("Expected change sets over the limit to be full")
+  }
+}
+
+func TestSettler(t *testing.T) {
+  start := time.Now()
+  policies := map[string]SettlePolicy{
+    "/quick": SettlePolicy{},
+    "/slow": SettlePolicy{Quiet: time.Minute, MaxDelay: 5 * time.Minute},
+  }
+  policy := func(root string) (SettlePolicy, error) {
+    settle, ok := policies[root]
+    if !ok {
+      return SettlePolicy{}, fmt.Errorf("Unknown root %s", root)
+    }
+    return settle, nil
+  }
+
+  s := newSettler()
+  s.changed("/quick", start)
+  s.changed("/slow", start)
+  s.changed("/removed", start)
+  if roots := s.settled(start.Add(time.Second), policy); len(roots) != 0 {
+    t.Errorf("Expected nothing to settle yet but got %v", roots)
+  }
+  if _, ok := s.first["/removed"]; ok {
+    t.Errorf("Expected unknown roots to be forgotten")
+  }
+  if roots := s.settled(start.Add(DefaultSettleQuiet), policy); !reflect.DeepEqual(roots, []string{"/quick"}) {
+    t.Errorf("Expected /quick to settle but got %v", roots)
+  }
+
+  // Changes that keep coming are held back no longer than MaxDelay
+  for at := time.Duration(0); at < 5 * time.Minute; at += 30 * time.Second {
+    s.changed("/slow", start.Add(at))
+    if roots := s.settled(start.Add(at), policy); len(roots) != 0 {
+      t.Fatalf("Expected /slow to wait at %v but got %v", at, roots)
+    }
+  }
+  if roots := s.settled(start.Add(5 * time.Minute), policy); !reflect.DeepEqual(roots, []string{"/slow"}) {
+    t.Errorf("Expected /slow to be backed up after its maximum delay but got %v", roots)
+  }
+
+  if err := validateSettle(SettlePolicy{Quiet: time.Minute, MaxDelay: time.Second}); err == nil {
+    t.Errorf("Expected a maximum delay shorter than the quiet window to be refused")
+  }
+  if settle := (SettlePolicy{Quiet: time.Hour}).effective(); settle.MaxDelay != time.Hour {
+    t.Errorf("Expected the default cap to stretch to the quiet window but got %v", settle.MaxDelay)
+  }
+}
+
+func expectChange(t *testing.T, d *fsDetector, root string) Change {
+  t.Helper()
+  change, err := d.NextChange()
+  if err != nil {
+    t.Fatalf("Expected a change of %s but got %v", root, err)
+  }
+  if change.Root != root {
+    t.Errorf("Expected a change of %s but got %s", root, change.Root)
+  }
+  return change
+}
+
+// drainChanges() consumes changes until none arrive for a while
+func drainChanges(d *fsDetector) {
+  for {
+    if _, err := d.NextChange(); err != nil {
+      return
+    }
+  }
+}
+
+func writeDetectorFile(t *testing.T, path string) {
+  if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestUnbackupCancelsJobs(t *testing.T) {
+  mdb := &TestMDB{db: make(map[string]MDBRow)}
+  mdb.InsertRow(MDBRow{OriginalRoot: "/orig", DriveLabel: "drive"})
+  queue := NewJobQueue(1, nil)
+
+  started := make(chan struct{})
+  running := queue.Enqueue("/orig", "drive", ChangeTrigger, false, func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error) {
+    close(started)
+    <-ctx.Done()
+    return nil, ctx.Err()
+  })
+  <-started
+  queued := queue.Enqueue("/orig", "drive", ManualTrigger, true, func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error) {
+    t.Errorf("Expected the queued job of a removed root to never run")
+    return nil, nil
+  })
+
+  if err := unbackupCommand(RootArgs{Root: "/orig"}, nil, mdb, queue, nil); err != nil {
+    t.Fatal(err)
+  }
+  for _, id := range []string{running.ID, queued.ID} {
+    if job, _ := queue.Get(id); job.State != JobCanceled {
+      t.Errorf("Expected job %s to be canceled but it is %s", id, job.State)
+    }
+  }
+  if _, err := mdb.GetRow("/orig"); err == nil {
+    t.Errorf("Expected the row to be deleted")
+  }
+}
+
+func TestPausePersists(t *testing.T) {
+  mdb := &TestMDB{db: make(map[string]MDBRow)}
+  mdb.InsertRow(MDBRow{OriginalRoot: "/a"})
+  mdb.InsertRow(MDBRow{OriginalRoot: "/b"})
+
+  if err := pauseCommand(RootArgs{Root: "/a/sub"}, mdb, NewJobQueue(1, nil)); err != nil {
+    t.Fatal(err)
+  }
+  // A restarted daemon starts with a fresh queue
+  queue := NewJobQueue(1, nil)
+  restorePauses(mdb, queue)
+  if !queue.Paused("/a") || queue.Paused("/b") {
+    t.Errorf("Expected only /a to be paused after a restart")
+  }
+
+  if err := pauseCommand(RootArgs{}, mdb, queue); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := resumeCommand(RootArgs{Root: "/a"}, nil, mdb, queue); err != nil {
+    t.Fatal(err)
+  }
+  queue = NewJobQueue(1, nil)
+  restorePauses(mdb, queue)
+  if queue.Paused("/a") || !queue.Paused("/b") {
+    t.Errorf("Expected only /b to be paused after a restart")
+  }
+}
+
+// testGenerator hands out the same reflector for every root
+type testGenerator struct {
+  reflector Reflector
+}
+
+func (g testGenerator) Reflect(code ReflectorCode, original string, reflection string) (Reflector, error) {
+  return g.reflector, nil
+}
+
+// testPruner reports on started whenever it prunes
+type testPruner struct {
+  started chan<- string
+}
+
+func (p testPruner) Backup(ctx context.Context) error {
+  return nil
+}
+
+func (p testPruner) Prune(policy RetentionPolicy, dryRun bool) ([]string, error) {
+  p.started<-"prune"
+  return []string{"old"}, nil
+}
+
+func TestPruneWaitsForDrive(t *testing.T) {
+  mdb := &TestMDB{db: make(map[string]MDBRow)}
+  mdb.InsertRow(MDBRow{OriginalRoot: "/orig", ReflectionRoot: "/ref", DriveLabel: "drive"})
+  queue := NewJobQueue(2, nil)
+  started := make(chan string, 2)
+  release := make(chan struct{})
+
+  queue.Enqueue("/other", "drive", ManualTrigger, true, blockingJob(started, "backup", release))
+  expectStarted(t, started, "backup")
+
+  type result struct {
+    pruned []string
+    err error
+  }
+  done := make(chan result, 1)
+  go func() {
+    pruned, err := pruneCommand(PruneArgs{Root: "/orig"}, testGenerator{testPruner{started}}, mdb, queue)
+    done<-result{pruned, err}
+  }()
+  expectNotStarted(t, started)
+
+  close(release)
+  expectStarted(t, started, "prune")
+  res := <-done
+  if res.err != nil {
+    t.Fatal(res.err)
+  }
+  if !reflect.DeepEqual(res.pruned, []string{"old"}) {
+    t.Errorf("Expected the pruned snapshots but got %v", res.pruned)
+  }
+  if jobs := queue.Jobs(); len(jobs) != 2 || jobs[1].Kind != PruneJob {
+    t.Errorf("Expected the prune to run as a job but got %+v", jobs)
+  }
+}
+
+func TestListAndStatus(t *testing.T) {
+  mdb := &TestMDB{db: make(map[string]MDBRow)}
+  mdb.InsertRow(MDBRow{OriginalRoot: "/b", DriveLabel: "usb"})
+  mdb.InsertRow(MDBRow{OriginalRoot: "/a", ReflectionRoot: "/media/usb/a", DriveLabel: "usb", HasChanged: true})
+  succeeded := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+  mdb.AddRun(RunRecord{OriginalRoot: "/a", End: succeeded})
+  mdb.AddRun(RunRecord{OriginalRoot: "/a", End: succeeded.Add(time.Hour), Error: "disk full"})
+  queue := NewJobQueue(1, nil)
+  queue.Pause("/b")
+
+  statuses, err := listCommand(nil, mdb, queue)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(statuses) != 2 || statuses[0].OriginalRoot != "/a" || statuses[1].OriginalRoot != "/b" {
+    t.Fatalf("Expected /a and /b in order but got %+v", statuses)
+  }
+  a, b := statuses[0], statuses[1]
+  if !a.Mounted || b.Mounted {
+    t.Errorf("Expected only /a to be mounted")
+  }
+  if a.Paused || !b.Paused {
+    t.Errorf("Expected only /b to be paused")
+  }
+  if !a.HasChanged || b.HasChanged {
+    t.Errorf("Expected only /a to have changed")
+  }
+  if a.LastRun == nil || a.LastRun.Error != "disk full" {
+    t.Errorf("Expected the failed run to be the last run but got %+v", a.LastRun)
+  }
+  if a.LastSuccess == nil || !a.LastSuccess.Equal(succeeded) {
+    t.Errorf("Expected the last success to skip the failed run but got %v", a.LastSuccess)
+  }
+  if b.LastRun != nil || b.LastSuccess != nil {
+    t.Errorf("Expected no runs for /b")
+  }
+
+  statuses, err = statusCommand(RootArgs{Root: "/a/docs/file.txt"}, nil, mdb, queue)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(statuses) != 1 || statuses[0].OriginalRoot != "/a" {
+    t.Errorf("Expected the status of the containing root /a but got %+v", statuses)
+  }
+  if statuses, err = statusCommand(RootArgs{}, nil, mdb, queue); err != nil || len(statuses) != 2 {
+    t.Errorf("Expected the status of every root but got %+v: %v", statuses, err)
+  }
+  _, err = statusCommand(RootArgs{Root: "/elsewhere"}, nil, mdb, queue)
+  if code := toProtocolError(err).Code; code != UnknownRootError {
+    t.Errorf("Expected %s for a path outside every root but got %v", UnknownRootError, err)
+  }
+}
+
+// recordingGenerator hands out reflectors that report their root on backedUp
+type recordingGenerator struct {
+  backedUp chan string
+}
+
+func (g recordingGenerator) Reflect(code ReflectorCode, original string, reflection string) (Reflector, error) {
+  return recordingReflector{original, g.backedUp}, nil
+}
+
+type recordingReflector struct {
+  root string
+  backedUp chan<- string
+}
+
+func (r recordingReflector) Backup(ctx context.Context) error {
+  r.backedUp<-r.root
+  return nil
+}
+
+// waitJobs() waits for every job and returns them once they are done
+func waitJobs(t *testing.T, queue *JobQueue, jobs []Job) []Job {
+  t.Helper()
+  done := make([]Job, 0, len(jobs))
+  for _, job := range jobs {
+    job, err := queue.Wait(job.ID)
+    if err != nil {
+      t.Fatal(err)
+    }
+    done = append(done, job)
+  }
+  return done
+}
+
+func TestForcedBackup(t *testing.T) {
+  mdb := &TestMDB{db: make(map[string]MDBRow)}
+  mdb.InsertRow(MDBRow{OriginalRoot: "/a", ReflectionRoot: "/media/usb/a", DriveLabel: "usb"})
+  mdb.InsertRow(MDBRow{OriginalRoot: "/b", ReflectionRoot: "/media/usb/b", DriveLabel: "usb"})
+  gen := recordingGenerator{make(chan string, 10)}
+  queue := NewJobQueue(1, nil)
+
+  // Nothing changed so only forced backups run
+  jobs, err := backupCommand(BackupArgs{Root: "/a"}, gen, mdb, queue)
+  if err != nil || len(jobs) != 0 {
+    t.Fatalf("Expected an unchanged root not to be backed up but got %+v: %v", jobs, err)
+  }
+
+  jobs, err = backupCommand(BackupArgs{Force: true}, gen, mdb, queue)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(jobs) != 2 || jobs[0].Root != "/a" || jobs[1].Root != "/b" {
+    t.Fatalf("Expected every root to be backed up but got %+v", jobs)
+  }
+  for _, job := range waitJobs(t, queue, jobs) {
+    if job.State != JobDone || job.Trigger != ManualTrigger {
+      t.Errorf("Expected a finished manual backup of %s but got %+v", job.Root, job)
+    }
+  }
+  if first, second := <-gen.backedUp, <-gen.backedUp; first != "/a" || second != "/b" {
+    t.Errorf("Expected /a and /b to be backed up but got %s and %s", first, second)
+  }
+
+  jobs, err = backupCommand(BackupArgs{Root: "/b/docs/file.txt", Force: true}, gen, mdb, queue)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(jobs) != 1 || jobs[0].Root != "/b" {
+    t.Fatalf("Expected the containing root /b to be backed up but got %+v", jobs)
+  }
+  waitJobs(t, queue, jobs)
+  if root := <-gen.backedUp; root != "/b" {
+    t.Errorf("Expected /b to be backed up but got %s", root)
+  }
+
+  mdb.InsertRow(MDBRow{OriginalRoot: "/c", DriveLabel: "stick"})
+  jobs, err = backupCommand(BackupArgs{Root: "/c", Force: true}, gen, mdb, queue)
+  if err != nil {
+    t.Fatal(err)
+  }
+  jobs = waitJobs(t, queue, jobs)
+  if len(jobs) != 1 || jobs[0].Error == nil || jobs[0].Error.Code != NotMountedError {
+    t.Errorf("Expected the backup of an unmounted drive to fail with %s but got %+v", NotMountedError, jobs)
+  }
+
+  if _, err = backupCommand(BackupArgs{Root: "/elsewhere", Force: true}, gen, mdb, queue); err == nil {
+    t.Errorf("Expected a path outside every root to be refused")
+  }
+  select {
+    case root := <-gen.backedUp:
+      t.Errorf("Expected nothing else to be backed up but %s was", root)
+    default:
+  }
+}
+
+func TestResumeCatchesUp(t *testing.T) {
+  mdb := &TestMDB{db: make(map[string]MDBRow)}
+  mdb.InsertRow(MDBRow{OriginalRoot: "/a", ReflectionRoot: "/media/usb/a", DriveLabel: "usb"})
+  mdb.InsertRow(MDBRow{OriginalRoot: "/b", ReflectionRoot: "/media/usb/b", DriveLabel: "usb"})
+  mdb.InsertRow(MDBRow{OriginalRoot: "/c", DriveLabel: "stick", HasChanged: true})
+  gen := recordingGenerator{make(chan string, 10)}
+  queue := NewJobQueue(1, nil)
+
+  if err := pauseCommand(RootArgs{}, mdb, queue); err != nil {
+    t.Fatal(err)
+  }
+  // /a changes while paused
+  modifyRow("/a", mdb, func(mdbRow *MDBRow) {
+    mdbRow.HasChanged = true
+  })
+  jobs, err := backupCommand(BackupArgs{Root: "/a", Trigger: ChangeTrigger}, gen, mdb, queue)
+  if err != nil || len(jobs) != 0 {
+    t.Fatalf("Expected a paused root not to be backed up but got %+v: %v", jobs, err)
+  }
+
+  jobs, err = resumeCommand(RootArgs{}, gen, mdb, queue)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(jobs) != 1 || jobs[0].Root != "/a" || jobs[0].Trigger != ChangeTrigger {
+    t.Fatalf("Expected a catch-up backup of only /a but got %+v", jobs)
+  }
+  waitJobs(t, queue, jobs)
+  if root := <-gen.backedUp; root != "/a" {
+    t.Errorf("Expected /a to be backed up but got %s", root)
+  }
+  select {
+    case root := <-gen.backedUp:
+      t.Errorf("Expected nothing else to be backed up but %s was", root)
+    default:
+  }
+}
+
+func TestHistoryCommand(t *testing.T) {
+  mdb := &TestMDB{db: make(map[string]MDBRow)}
+  mdb.InsertRow(MDBRow{OriginalRoot: "/a"})
+  mdb.InsertRow(MDBRow{OriginalRoot: "/b"})
+  start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+  mdb.AddRun(RunRecord{OriginalRoot: "/a", Start: start})
+  mdb.AddRun(RunRecord{OriginalRoot: "/b", Start: start.Add(time.Hour)})
+  mdb.AddRun(RunRecord{OriginalRoot: "/a", Start: start.Add(2 * time.Hour), Error: "disk full"})
+
+  runs, err := historyCommand(RootArgs{}, nil, mdb)
+  if err != nil {
+    t.Fatal(err)
+  }
+  roots := make([]string, 0, len(runs))
+  for _, run := range runs {
+    roots = append(roots, run.OriginalRoot)
+  }
+  if !reflect.DeepEqual(roots, []string{"/a", "/b", "/a"}) {
+    t.Errorf("Expected the runs of every root from oldest to newest but got %v", roots)
+  }
+
+  for _, root := range []string{"/a", "/a/docs/file.txt"} {
+    runs, err = historyCommand(RootArgs{Root: root}, nil, mdb)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(runs) != 2 || runs[0].Error != "" || runs[1].Error != "disk full" {
+      t.Errorf("Expected the runs of /a for %s but got %+v", root, runs)
+    }
+  }
+
+  _, err = historyCommand(RootArgs{Root: "/elsewhere"}, nil, mdb)
+  if code := toProtocolError(err).Code; code != UnknownRootError {
+    t.Errorf("Expected %s for a path outside every root but got %v", UnknownRootError, err)
+  }
+}
+
+// failingMDB can't write deletions to disk
+type failingMDB struct {
+  *TestMDB
+}
+
+func (mdb failingMDB) DeleteRow(key string) (MDBRow, error) {
+  return MDBRow{}, fmt.Errorf("Disk full in failingMDB.DeleteRow()")
+}
+
+func TestUnbackupErrors(t *testing.T) {
+  mdb := failingMDB{&TestMDB{db: make(map[string]MDBRow)}}
+  mdb.InsertRow(MDBRow{OriginalRoot: "/orig"})
+  queue := NewJobQueue(1, nil)
+
+  err := unbackupCommand(RootArgs{Root: "/missing"}, nil, mdb, queue, nil)
+  if code := toProtocolError(err).Code; code != UnknownRootError {
+    t.Errorf("Expected %s for a missing root but got %v", UnknownRootError, err)
+  }
+  err = unbackupCommand(RootArgs{Root: "/orig"}, nil, mdb, queue, nil)
+  if code := toProtocolError(err).Code; code != CommandFailedError {
+    t.Errorf("Expected %s when the database can't be written but got %v", CommandFailedError, err)
+  }
+}
@@ -0,0 +1,354 @@
+package processor
+
+import (
+  "encoding/json"
+  "errors"
+  "strconv"
+  "strings"
+  "time"
+  "fmt"
+)
+
+/* Clients send a single line JSON encoded Request and receive a
+single line JSON encoded Response. Lines that don't start with '{'
+are read as the older "code:param1,param2" commands and are answered
+the old way with a response code optionally followed by output */
+const ProtocolVersion int = 1
+
+type ErrorCode string
+
+/* Every failure is tagged with one of these so clients can react
+to the class of failure without parsing the message */
+const (
+  InvalidRequestError ErrorCode = "invalid_request"
+  UnknownCommandError = "unknown_command"
+  UnknownRootError = "unknown_root"
+  NotMountedError = "not_mounted"
+  CopyFailedError = "copy_failed"
+  CanceledError = "canceled"
+  PermissionDeniedError = "permission_denied"
+  CommandFailedError = "command_failed"
+  // Only ever produced by clients that can't reach the daemon
+  DaemonUnreachableError = "daemon_unreachable"
+)
+
+type Request struct {
+  Version int `json:"version"`
+  ID string `json:"id,omitempty"`
+  Command CommandCode `json:"command"`
+  Args json.RawMessage `json:"args,omitempty"`
+}
+
+type Response struct {
+  Version int `json:"version"`
+  ID string `json:"id,omitempty"`
+  Status string `json:"status"`
+  Result json.RawMessage `json:"result,omitempty"`
+  Error *Error `json:"error,omitempty"`
+}
+
+type Error struct {
+  Code ErrorCode `json:"code"`
+  Message string `json:"message"`
+  cause error
+}
+
+func (e *Error) Error() string {
+  return e.Message
+}
+
+func (e *Error) Unwrap() error {
+  return e.cause
+}
+
+func newError(code ErrorCode, format string, a ...interface{}) *Error {
+  return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+/* classify() tags err with code. Errors that were already classified
+keep the code of the innermost classified error in their chain since
+it is the most specific one */
+func classify(code ErrorCode, err error) *Error {
+  for inner := err; inner != nil; inner = errors.Unwrap(inner) {
+    if perr, ok := inner.(*Error); ok {
+      code = perr.Code
+    }
+  }
+  return &Error{Code: code, Message: err.Error(), cause: err}
+}
+
+/* Call carries a message from a client to CommandProcessor() along
+with the channel its response should be sent on. Reply should be
+buffered so the processor never waits on a client. Most calls are
+answered with a single line but subscriptions keep sending events.
+Reply is closed once the answer is complete and Hangup is closed
+once the client has gone. Peer is nil when the client couldn't be
+identified and is fully trusted */
+type Call struct {
+  Message string
+  Reply chan string
+  Hangup chan struct{}
+  Peer *Peer
+}
+
+// Peer holds the credentials of the process that sent a Call
+type Peer struct {
+  PID int32
+  UID uint32
+  GID uint32
+}
+
+// NewCall() creates a Call with a buffered reply channel
+func NewCall(msg string, peer *Peer) Call {
+  return Call{
+    Message: msg,
+    Reply: make(chan string, 1),
+    Hangup: make(chan struct{}),
+    Peer: peer,
+  }
+}
+
+// Arguments of BackupCommand
+type BackupArgs struct {
+  Root string `json:"root"`
+  Trigger BackupTrigger `json:"trigger,omitempty"`
+  Force bool `json:"force,omitempty"`
+}
+
+// Arguments of NewBackupCommand
+type NewBackupArgs struct {
+  Original string `json:"original"`
+  Reflection string `json:"reflection"`
+  Reflector ReflectorCode `json:"reflector"`
+  Retention RetentionPolicy `json:"retention"`
+  Settle SettlePolicy `json:"settle"`
+  Detection DetectionMode `json:"detection,omitempty"`
+}
+
+// Arguments of JobCommand
+type JobArgs struct {
+  ID string `json:"id,omitempty"`
+  Wait bool `json:"wait,omitempty"`
+}
+
+/* Arguments of CancelCommand. A job id cancels that job, a root
+cancels every job of that root and neither cancels every job */
+type CancelArgs struct {
+  ID string `json:"id,omitempty"`
+  Root string `json:"root,omitempty"`
+}
+
+// Arguments of commands that only name a backup root
+type RootArgs struct {
+  Root string `json:"root,omitempty"`
+}
+
+// Arguments of RetentionCommand
+type RetentionArgs struct {
+  Root string `json:"root"`
+  Retention RetentionPolicy `json:"retention"`
+}
+
+// Arguments of SettleCommand
+type SettleArgs struct {
+  Root string `json:"root"`
+  Settle SettlePolicy `json:"settle"`
+}
+
+// Arguments of DetectionCommand
+type DetectionArgs struct {
+  Root string `json:"root"`
+  Detection DetectionMode `json:"detection"`
+}
+
+// Arguments of PruneCommand
+type PruneArgs struct {
+  Root string `json:"root"`
+  DryRun bool `json:"dry_run,omitempty"`
+}
+
+// Arguments of RestoreCommand
+type RestoreArgs struct {
+  Root string `json:"root,omitempty"`
+  Target string `json:"target,omitempty"`
+  Path string `json:"path,omitempty"`
+  Snapshot string `json:"snapshot,omitempty"`
+  At time.Time `json:"at,omitempty"`
+  Policy ConflictPolicy `json:"policy"`
+  DryRun bool `json:"dry_run,omitempty"`
+}
+
+// NewRequest() encodes args into a Request for cmd
+func NewRequest(id string, cmd CommandCode, args interface{}) (Request, error) {
+  serial, err := json.Marshal(args)
+  if err != nil {
+    return Request{}, fmt.Errorf("Failed to serialize args in NewRequest(): %v", err)
+  }
+  return Request{Version: ProtocolVersion, ID: id, Command: cmd, Args: serial}, nil
+}
+
+// DecodeResult() decodes the result of a successful response into result
+func (r Response) DecodeResult(result interface{}) error {
+  if r.Error != nil {
+    return r.Error
+  }
+  if len(r.Result) == 0 {
+    return nil
+  }
+  return json.Unmarshal(r.Result, result)
+}
+
+/* DecodeRequest() reads a request sent by a client and reports
+whether it used the legacy string format */
+func DecodeRequest(msg string) (Request, bool, error) {
+  msg = strings.TrimSpace(msg)
+  if !strings.HasPrefix(msg, "{") {
+    req, err := parseLegacyCommand(msg)
+    return req, true, err
+  }
+
+  var req Request
+  if err := json.Unmarshal([]byte(msg), &req); err != nil {
+    return Request{}, false, fmt.Errorf("Invalid request in DecodeRequest(): %v", err)
+  }
+  if req.Version > ProtocolVersion {
+    return req, false, fmt.Errorf("Unsupported protocol version %d in DecodeRequest()", req.Version)
+  }
+  return req, false, nil
+}
+
+/* encodeResponse() answers req with either the result of the
+command or the error it failed with */
+func encodeResponse(req Request, legacy bool, result interface{}, err error) string {
+  if legacy {
+    return encodeLegacyResponse(result, err)
+  }
+
+  resp := Response{Version: ProtocolVersion, ID: req.ID, Status: SuccessCode}
+  if err != nil {
+    resp.Status = FailCode
+    resp.Error = toProtocolError(err)
+  } else if result != nil {
+    serial, serr := json.Marshal(result)
+    if serr != nil {
+      resp.Status = FailCode
+      resp.Error = &Error{Code: CommandFailedError, Message: serr.Error()}
+    } else {
+      resp.Result = serial
+    }
+  }
+
+  serial, _ := json.Marshal(resp)
+  return string(serial)
+}
+
+/* toProtocolError() sends the whole error chain as the message
+along with the code of the innermost classified error */
+func toProtocolError(err error) *Error {
+  return classify(CommandFailedError, err)
+}
+
+/* Legacy clients get the response code followed by any output,
+with lists of strings written one per line */
+func encodeLegacyResponse(result interface{}, err error) string {
+  if err != nil {
+    return FailCode
+  }
+  output := ""
+  if lines, ok := result.([]string); ok {
+    output = strings.Join(lines, "\n")
+  } else if result != nil {
+    serial, _ := json.Marshal(result)
+    output = string(serial)
+  }
+  if output == "" {
+    return SuccessCode
+  }
+  return SuccessCode+"\n"+output
+}
+
+/* parseLegacyCommand() translates "command_code:param1,param2,..."
+into a Request with the same positional parameters as before */
+func parseLegacyCommand(cmd string) (Request, error) {
+  cmdComponents := strings.SplitN(cmd, ":", 2)
+  if len(cmdComponents) < 2 {
+    return Request{}, fmt.Errorf("Invalid command input(%s) in parseLegacyCommand()", cmd)
+  }
+  cmdType := CommandCode(cmdComponents[0])
+  params := strings.Split(cmdComponents[1], ",")
+  param := func(i int) string {
+    if i < len(params) {
+      return params[i]
+    }
+    return ""
+  }
+  flag := func(i int) (bool, error) {
+    if param(i) == "" {
+      return false, nil
+    }
+    return strconv.ParseBool(param(i))
+  }
+  duration := func(i int) (time.Duration, error) {
+    if param(i) == "" {
+      return 0, nil
+    }
+    return time.ParseDuration(param(i))
+  }
+
+  var args interface{}
+  var err error
+  switch cmdType {
+    case BackupCommand:
+      backupArgs := BackupArgs{Root: param(0), Trigger: BackupTrigger(param(1))}
+      backupArgs.Force, err = flag(2)
+      args = backupArgs
+    case NewBackupCommand:
+      newArgs := NewBackupArgs{Original: param(0), Reflection: param(1), Reflector: ReflectorCode(param(2))}
+      if len(params) > 3 {
+        newArgs.Retention, err = ParseRetention(params[3:])
+      }
+      args = newArgs
+    case JobCommand:
+      jobArgs := JobArgs{ID: param(0)}
+      jobArgs.Wait, err = flag(1)
+      args = jobArgs
+    case CancelCommand:
+      args = CancelArgs{ID: param(0), Root: param(1)}
+    case UnbackupCommand, HistoryCommand, ListCommand, StatusCommand, PauseCommand, ResumeCommand:
+      args = RootArgs{Root: param(0)}
+    case RetentionCommand:
+      retArgs := RetentionArgs{Root: param(0)}
+      if len(params) > 1 {
+        retArgs.Retention, err = ParseRetention(params[1:])
+      }
+      args = retArgs
+    case SettleCommand:
+      settleArgs := SettleArgs{Root: param(0)}
+      settleArgs.Settle.Quiet, err = duration(1)
+      if err == nil {
+        settleArgs.Settle.MaxDelay, err = duration(2)
+      }
+      args = settleArgs
+    case DetectionCommand:
+      args = DetectionArgs{Root: param(0), Detection: DetectionMode(param(1))}
+    case PruneCommand:
+      pruneArgs := PruneArgs{Root: param(0)}
+      pruneArgs.DryRun, err = flag(1)
+      args = pruneArgs
+    case RestoreCommand:
+      restoreArgs := RestoreArgs{Root: param(0), Target: param(1), Snapshot: param(2),
+        Policy: ConflictPolicy(param(3)), Path: param(5)}
+      restoreArgs.DryRun, err = flag(4)
+      if err == nil && param(6) != "" {
+        restoreArgs.At, err = time.Parse(time.RFC3339, param(6))
+      }
+      args = restoreArgs
+    default:
+      args = struct{}{}
+  }
+
+  if err != nil {
+    return Request{}, fmt.Errorf("Invalid parameters in command(%s) in parseLegacyCommand(): %v", cmd, err)
+  }
+  return NewRequest("", cmdType, args)
+}
@@ -0,0 +1,179 @@
+package processor
+
+import (
+  "encoding/json"
+  "fmt"
+  "reflect"
+  "testing"
+  "time"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+  args := RestoreArgs{Root: "/orig", Target: "/tmp/out", Path: "a/b.txt", Policy: SkipConflicts, DryRun: true}
+  req, err := NewRequest("42", RestoreCommand, args)
+  if err != nil {
+    t.Fatal(err)
+  }
+  serial, err := json.Marshal(req)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  decoded, legacy, err := DecodeRequest(string(serial)+"\n")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if legacy {
+    t.Errorf("Expected a JSON request not to be legacy")
+  }
+  if decoded.Version != ProtocolVersion || decoded.ID != "42" || decoded.Command != RestoreCommand {
+    t.Errorf("Expected the request to survive but got %+v", decoded)
+  }
+  var decodedArgs RestoreArgs
+  if err = decodeArgs(decoded, &decodedArgs); err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(decodedArgs, args) {
+    t.Errorf("Expected args %+v but got %+v", args, decodedArgs)
+  }
+}
+
+func TestRequestVersion(t *testing.T) {
+  older := fmt.Sprintf(`{"version":%d,"command":"lst"}`, ProtocolVersion - 1)
+  if _, _, err := DecodeRequest(older); err != nil {
+    t.Errorf("Expected older versions to be accepted but got %v", err)
+  }
+  newer := fmt.Sprintf(`{"version":%d,"command":"lst"}`, ProtocolVersion + 1)
+  if _, _, err := DecodeRequest(newer); err == nil {
+    t.Errorf("Expected newer versions to be refused")
+  }
+}
+
+func TestMalformedRequests(t *testing.T) {
+  for _, msg := range []string{
+    `{"version":1,"command":`,
+    `{"version":"one","command":"lst"}`,
+    `no colon`,
+    `bak:/orig,change,maybe`,
+    `rst:/orig,/tmp,,skip,false,,yesterday`,
+    `ret:/orig,1,2,3`,
+    `stl:/orig,soon`,
+  } {
+    if _, _, err := DecodeRequest(msg); err == nil {
+      t.Errorf("Expected %q to be refused", msg)
+    }
+  }
+
+  // Args that don't fit the command fail when they are decoded
+  req, _, err := DecodeRequest(`{"version":1,"command":"bak","args":{"force":"yes"}}`)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var args BackupArgs
+  if err = decodeArgs(req, &args); err == nil || toProtocolError(err).Code != InvalidRequestError {
+    t.Errorf("Expected mistyped args to be an invalid request but got %v", err)
+  }
+}
+
+func TestLegacyRequests(t *testing.T) {
+  at := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+  tests := []struct {
+    msg string
+    cmd CommandCode
+    args interface{}
+    decoded interface{}
+  }{
+    {"bak:/orig,change,true", BackupCommand, &BackupArgs{}, &BackupArgs{Root: "/orig", Trigger: ChangeTrigger, Force: true}},
+    {"bak:/orig", BackupCommand, &BackupArgs{}, &BackupArgs{Root: "/orig"}},
+    {"n_bak:/orig,/refl,snap,5,0,7,0,12,1024", NewBackupCommand, &NewBackupArgs{},
+      &NewBackupArgs{Original: "/orig", Reflection: "/refl", Reflector: "snap",
+        Retention: RetentionPolicy{KeepLast: 5, Daily: 7, Monthly: 12, MaxSize: 1024}}},
+    {"u_bak:/orig", UnbackupCommand, &RootArgs{}, &RootArgs{Root: "/orig"}},
+    {"cnl:,/orig", CancelCommand, &CancelArgs{}, &CancelArgs{Root: "/orig"}},
+    {"stl:/orig,10s,5m", SettleCommand, &SettleArgs{}, &SettleArgs{Root: "/orig", Settle: SettlePolicy{Quiet: 10 * time.Second, MaxDelay: 5 * time.Minute}}},
+    {"rst:/orig,/tmp/out,,keep-both,true,a.txt,2026-10-18T09:00:00Z", RestoreCommand, &RestoreArgs{},
+      &RestoreArgs{Root: "/orig", Target: "/tmp/out", Policy: KeepBothConflicts, DryRun: true, Path: "a.txt", At: at}},
+  }
+
+  for _, test := range tests {
+    req, legacy, err := DecodeRequest(test.msg)
+    if err != nil {
+      t.Errorf("%s: %v", test.msg, err)
+      continue
+    }
+    if !legacy || req.Command != test.cmd {
+      t.Errorf("%s: Expected legacy %s but got %s", test.msg, test.cmd, req.Command)
+    }
+    if err = decodeArgs(req, test.args); err != nil {
+      t.Errorf("%s: %v", test.msg, err)
+    } else if !reflect.DeepEqual(test.args, test.decoded) {
+      t.Errorf("%s: Expected %+v but got %+v", test.msg, test.decoded, test.args)
+    }
+  }
+}
+
+func TestEncodeResponse(t *testing.T) {
+  req := Request{Version: ProtocolVersion, ID: "7", Command: ListCommand}
+
+  var resp Response
+  line := encodeResponse(req, false, []string{"a", "b"}, nil)
+  if err := json.Unmarshal([]byte(line), &resp); err != nil {
+    t.Fatal(err)
+  }
+  var result []string
+  if err := resp.DecodeResult(&result); err != nil || resp.ID != "7" || resp.Status != SuccessCode || !reflect.DeepEqual(result, []string{"a", "b"}) {
+    t.Errorf("Expected a successful response with the result but got %s: %v", line, err)
+  }
+
+  line = encodeResponse(req, false, nil, fmt.Errorf("Outer: %w", newError(UnknownRootError, "No such root")))
+  resp = Response{}
+  if err := json.Unmarshal([]byte(line), &resp); err != nil {
+    t.Fatal(err)
+  }
+  if resp.Status != FailCode || resp.Error == nil || resp.Error.Code != UnknownRootError || resp.Error.Message != "Outer: No such root" {
+    t.Errorf("Expected the classified error with its whole message but got %s", line)
+  }
+  if err := resp.DecodeResult(&result); err != resp.Error {
+    t.Errorf("Expected DecodeResult() to return the error of the response but got %v", err)
+  }
+
+  legacyTests := []struct {
+    result interface{}
+    err error
+    line string
+  }{
+    {nil, nil, SuccessCode},
+    {[]string{"a", "b"}, nil, SuccessCode+"\na\nb"},
+    {map[string]int{"n": 1}, nil, SuccessCode+"\n"+`{"n":1}`},
+    {[]string{"ignored"}, fmt.Errorf("failed"), FailCode},
+  }
+  for _, test := range legacyTests {
+    if line := encodeResponse(req, true, test.result, test.err); line != test.line {
+      t.Errorf("Expected legacy response %q but got %q", test.line, line)
+    }
+  }
+}
+
+func TestErrorClassSurvivesChain(t *testing.T) {
+  inner := newError(NotMountedError, "Drive isn't mounted")
+  wrapped := fmt.Errorf("Couldn't locate reflection: %w", inner)
+  // A broader class around it doesn't hide the more specific one
+  outer := &Error{Code: CopyFailedError, Message: wrapped.Error(), cause: wrapped}
+  err := fmt.Errorf("Backup failed: %w", classify(CommandFailedError, outer))
+
+  var resp Response
+  line := encodeResponse(Request{Version: ProtocolVersion}, false, nil, err)
+  if jerr := json.Unmarshal([]byte(line), &resp); jerr != nil {
+    t.Fatal(jerr)
+  }
+  if resp.Error == nil || resp.Error.Code != NotMountedError {
+    t.Errorf("Expected %s to survive the chain but got %s", NotMountedError, line)
+  }
+  if resp.Error.Message != err.Error() {
+    t.Errorf("Expected the whole chain as the message but got %q", resp.Error.Message)
+  }
+
+  if code := toProtocolError(fmt.Errorf("plain")).Code; code != CommandFailedError {
+    t.Errorf("Expected unclassified errors to be %s but got %s", CommandFailedError, code)
+  }
+}
@@ -0,0 +1,458 @@
+package processor
+
+import (
+  "context"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "fmt"
+)
+
+type JobState string
+
+const (
+  JobQueued JobState = "queued"
+  JobRunning = "running"
+  JobDone = "done"
+  JobFailed = "failed"
+  JobCanceled = "canceled"
+)
+
+type JobKind string
+
+const (
+  BackupJob JobKind = "backup"
+  RestoreJob = "restore"
+  PruneJob = "prune"
+)
+
+// Number of finished jobs remembered so clients can still poll them
+var JobHistoryLimit int = 100
+
+/* Job is a backup, restore or prune of a single root waiting in or
+taken from a JobQueue. Run is empty for restores and prunes and when
+the backup turned out to have nothing to do */
+type Job struct {
+  ID string `json:"id"`
+  Kind JobKind `json:"kind"`
+  Root string `json:"root"`
+  Drive string `json:"drive"`
+  Trigger BackupTrigger `json:"trigger"`
+  Force bool `json:"force,omitempty"`
+  State JobState `json:"state"`
+  Queued time.Time `json:"queued"`
+  Started *time.Time `json:"started,omitempty"`
+  Finished *time.Time `json:"finished,omitempty"`
+  Progress *BackupProgress `json:"progress,omitempty"`
+  Run *RunRecord `json:"run,omitempty"`
+  Error *Error `json:"error,omitempty"`
+}
+
+/* JobFunc performs the work of a job until ctx is canceled.
+It may send how far it has come on progress until it returns */
+type JobFunc func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error)
+
+type queuedJob struct {
+  job Job
+  run JobFunc
+  cancel context.CancelFunc
+  done chan struct{}
+  copyStart time.Time
+}
+
+/* JobQueue runs backup and restore jobs on a fixed number of
+workers. Jobs using the same drive never run at the same time so a
+single disk isn't slowed down by parallel writers and a restore never
+reads a reflection that is being backed up. It also remembers which
+roots have their automatic backups paused. Backup jobs starting,
+making progress and finishing are published on events */
+type JobQueue struct {
+  mutex *sync.Mutex
+  cond *sync.Cond
+  nextID int
+  pending []*queuedJob
+  jobs map[string]*queuedJob
+  order []string
+  busyDrives map[string]bool
+  pausedAll bool
+  pausedRoots map[string]bool
+  historyLimit int
+  events *EventBus
+}
+
+// NewJobQueue() creates a JobQueue and starts its workers
+func NewJobQueue(workers int, events *EventBus) *JobQueue {
+  if workers < 1 {
+    workers = 1
+  }
+  mutex := &sync.Mutex{}
+  q := &JobQueue{
+    mutex: mutex,
+    cond: sync.NewCond(mutex),
+    nextID: 1,
+    pending: make([]*queuedJob, 0),
+    jobs: make(map[string]*queuedJob),
+    order: make([]string, 0),
+    busyDrives: make(map[string]bool),
+    pausedRoots: make(map[string]bool),
+    historyLimit: JobHistoryLimit,
+    events: events,
+  }
+  for i := 0; i < workers; i++ {
+    go q.work()
+  }
+  return q
+}
+
+/* Enqueue() adds a backup of root to drive to the queue. If the same
+backup is already waiting that job is returned instead of queueing
+it twice */
+func (q *JobQueue) Enqueue(root string, drive string, trigger BackupTrigger, force bool, run JobFunc) Job {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  for _, qj := range q.pending {
+    if qj.job.Kind == BackupJob && qj.job.Root == root && qj.job.Force == force {
+      return qj.job
+    }
+  }
+  return q.add(Job{Kind: BackupJob, Root: root, Drive: drive, Trigger: trigger, Force: force}, run)
+}
+
+/* EnqueueRestore() adds a restore from the reflection of root on
+drive to the queue. Restores are always asked for by hand */
+func (q *JobQueue) EnqueueRestore(root string, drive string, run JobFunc) Job {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  return q.add(Job{Kind: RestoreJob, Root: root, Drive: drive, Trigger: ManualTrigger}, run)
+}
+
+/* EnqueuePrune() adds a prune of the snapshots of root on drive to
+the queue. Prunes are always asked for by hand */
+func (q *JobQueue) EnqueuePrune(root string, drive string, run JobFunc) Job {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  return q.add(Job{Kind: PruneJob, Root: root, Drive: drive, Trigger: ManualTrigger}, run)
+}
+
+// add() must be called with the mutex held
+func (q *JobQueue) add(job Job, run JobFunc) Job {
+  if job.Drive == "" {
+    job.Drive = job.Root
+  }
+  job.ID = strconv.Itoa(q.nextID)
+  job.State = JobQueued
+  job.Queued = time.Now()
+  qj := &queuedJob{
+    job: job,
+    run: run,
+    done: make(chan struct{}),
+  }
+  q.nextID++
+  q.pending = append(q.pending, qj)
+  q.jobs[qj.job.ID] = qj
+  q.order = append(q.order, qj.job.ID)
+  q.cond.Broadcast()
+  return qj.job
+}
+
+func (q *JobQueue) Get(id string) (Job, error) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  qj, ok := q.jobs[id]
+  if !ok {
+    return Job{}, newError(InvalidRequestError, "No job with id %s", id)
+  }
+  return qj.job, nil
+}
+
+// Wait() blocks until job id has finished
+func (q *JobQueue) Wait(id string) (Job, error) {
+  q.mutex.Lock()
+  qj, ok := q.jobs[id]
+  q.mutex.Unlock()
+  if !ok {
+    return Job{}, newError(InvalidRequestError, "No job with id %s", id)
+  }
+
+  <-qj.done
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  return qj.job, nil
+}
+
+/* Cancel() removes job id from the queue or stops it if it is
+already running. The canceled job is returned once it has stopped */
+func (q *JobQueue) Cancel(id string) (Job, error) {
+  q.mutex.Lock()
+  qj, ok := q.jobs[id]
+  if !ok {
+    q.mutex.Unlock()
+    return Job{}, newError(InvalidRequestError, "No job with id %s", id)
+  }
+  q.cancelJob(qj)
+  q.mutex.Unlock()
+  return q.Wait(id)
+}
+
+/* CancelRoot() cancels every queued and running job of root or of
+every root when root is empty */
+func (q *JobQueue) CancelRoot(root string) []Job {
+  q.mutex.Lock()
+  canceled := make([]string, 0)
+  for _, id := range q.order {
+    qj := q.jobs[id]
+    if root != "" && qj.job.Root != root {
+      continue
+    }
+    if q.cancelJob(qj) {
+      canceled = append(canceled, id)
+    }
+  }
+  q.mutex.Unlock()
+
+  jobs := make([]Job, 0, len(canceled))
+  for _, id := range canceled {
+    if job, err := q.Wait(id); err == nil {
+      jobs = append(jobs, job)
+    }
+  }
+  return jobs
+}
+
+/* cancelJob() must be called with the mutex held. Queued jobs are
+finished right away and running jobs finish once their backup
+notices the canceled context */
+func (q *JobQueue) cancelJob(qj *queuedJob) bool {
+  switch qj.job.State {
+    case JobQueued:
+      for i, pending := range q.pending {
+        if pending == qj {
+          q.pending = append(q.pending[:i], q.pending[i+1:]...)
+          break
+        }
+      }
+      finished := time.Now()
+      qj.job.State = JobCanceled
+      qj.job.Finished = &finished
+      qj.job.Error = newError(CanceledError, "Job %s was canceled before it started", qj.job.ID)
+      close(qj.done)
+      return true
+    case JobRunning:
+      qj.cancel()
+      return true
+  }
+  return false
+}
+
+/* Pause() stops automatic backups of root, or of every root when
+root is empty, until Resume() is called. Automatic backups that are
+already queued wait too. Backups started by hand still run */
+func (q *JobQueue) Pause(root string) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  if root == "" {
+    q.pausedAll = true
+  } else {
+    q.pausedRoots[root] = true
+  }
+}
+
+/* Resume() undoes Pause(). Resuming every root also clears the
+pauses of single roots */
+func (q *JobQueue) Resume(root string) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  if root == "" {
+    q.pausedAll = false
+    q.pausedRoots = make(map[string]bool)
+  } else {
+    delete(q.pausedRoots, root)
+  }
+  q.cond.Broadcast()
+}
+
+func (q *JobQueue) Paused(root string) bool {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  return q.paused(root)
+}
+
+// paused() must be called with the mutex held
+func (q *JobQueue) paused(root string) bool {
+  return q.pausedAll || q.pausedRoots[root]
+}
+
+/* Active() returns the running backup of root or else the
+oldest queued one. Restores are left out */
+func (q *JobQueue) Active(root string) (Job, bool) {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  var active *queuedJob
+  for _, id := range q.order {
+    qj := q.jobs[id]
+    if qj.job.Root != root || qj.job.Kind != BackupJob {
+      continue
+    }
+    if qj.job.State == JobRunning {
+      return qj.job, true
+    }
+    if qj.job.State == JobQueued && active == nil {
+      active = qj
+    }
+  }
+  if active == nil {
+    return Job{}, false
+  }
+  return active.job, true
+}
+
+// Jobs() returns every queued, running and remembered job oldest first
+func (q *JobQueue) Jobs() []Job {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+
+  jobs := make([]Job, 0, len(q.order))
+  for _, id := range q.order {
+    jobs = append(jobs, q.jobs[id].job)
+  }
+  return jobs
+}
+
+func (q *JobQueue) work() {
+  q.mutex.Lock()
+  defer q.mutex.Unlock()
+  for {
+    qj := q.nextRunnable()
+    if qj == nil {
+      q.cond.Wait()
+      continue
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    started := time.Now()
+    qj.job.State = JobRunning
+    qj.job.Started = &started
+    qj.cancel = cancel
+    q.busyDrives[qj.job.Drive] = true
+    q.publish(BackupStartedEvent, qj)
+    q.mutex.Unlock()
+
+    progress := make(chan BackupProgress, 1)
+    tracked := make(chan struct{})
+    go q.trackProgress(qj, progress, tracked)
+    run, err := q.runJob(ctx, qj, progress)
+    close(progress)
+    <-tracked
+
+    q.mutex.Lock()
+    finished := time.Now()
+    qj.job.Finished = &finished
+    qj.job.Progress = nil
+    qj.job.Run = run
+    qj.job.State = JobDone
+    if err != nil && ctx.Err() != nil {
+      qj.job.State = JobCanceled
+      qj.job.Error = toProtocolError(classify(CanceledError, err))
+    } else if err != nil {
+      qj.job.State = JobFailed
+      qj.job.Error = toProtocolError(err)
+    }
+    if qj.job.State == JobDone {
+      q.publish(BackupFinishedEvent, qj)
+    } else {
+      q.publish(BackupFailedEvent, qj)
+    }
+    cancel()
+    delete(q.busyDrives, qj.job.Drive)
+    close(qj.done)
+    q.forgetFinished()
+    q.cond.Broadcast()
+  }
+}
+
+// A panicking job fails rather than taking down the worker
+func (q *JobQueue) runJob(ctx context.Context, qj *queuedJob, progress chan<- BackupProgress) (run *RunRecord, err error) {
+  defer func() {
+    if r := recover(); r != nil {
+      err = fmt.Errorf("%s of %s panicked: %v", strings.Title(string(qj.job.Kind)), qj.job.Root, r)
+    }
+  }()
+  return qj.run(ctx, progress)
+}
+
+/* trackProgress() keeps the progress of a running job up to date
+until progress is closed. The ETA assumes the rest is copied as fast
+as what has been copied so far */
+func (q *JobQueue) trackProgress(qj *queuedJob, progress <-chan BackupProgress, tracked chan<- struct{}) {
+  defer close(tracked)
+  for update := range progress {
+    q.mutex.Lock()
+    if update.Phase == CopyingPhase && qj.copyStart.IsZero() {
+      qj.copyStart = time.Now()
+    }
+    update.ETA = 0
+    if !qj.copyStart.IsZero() && update.BytesDone > 0 && update.BytesTotal > update.BytesDone {
+      elapsed := time.Since(qj.copyStart)
+      left := float64(update.BytesTotal - update.BytesDone) / float64(update.BytesDone)
+      update.ETA = time.Duration(float64(elapsed) * left).Round(time.Second)
+    }
+    current := update
+    qj.job.Progress = &current
+    q.publish(BackupProgressEvent, qj)
+    q.mutex.Unlock()
+  }
+}
+
+// publish() must be called with the mutex held
+func (q *JobQueue) publish(eventType EventType, qj *queuedJob) {
+  if qj.job.Kind != BackupJob {
+    return
+  }
+  job := qj.job
+  q.events.Publish(Event{Type: eventType, Root: job.Root, Job: &job})
+}
+
+/* nextRunnable() takes the oldest pending job whose drive isn't
+already in use off the queue. Automatic jobs of paused roots are
+held until they are resumed */
+func (q *JobQueue) nextRunnable() *queuedJob {
+  for i, qj := range q.pending {
+    if q.busyDrives[qj.job.Drive] {
+      continue
+    }
+    if qj.job.Trigger != ManualTrigger && q.paused(qj.job.Root) {
+      continue
+    }
+    q.pending = append(q.pending[:i], q.pending[i+1:]...)
+    return qj
+  }
+  return nil
+}
+
+func (q *JobQueue) forgetFinished() {
+  finished := 0
+  for _, id := range q.order {
+    if q.jobs[id].finished() {
+      finished++
+    }
+  }
+
+  kept := make([]string, 0, len(q.order))
+  for _, id := range q.order {
+    if finished > q.historyLimit && q.jobs[id].finished() {
+      delete(q.jobs, id)
+      finished--
+      continue
+    }
+    kept = append(kept, id)
+  }
+  q.order = kept
+}
+
+func (qj *queuedJob) finished() bool {
+  return qj.job.State != JobQueued && qj.job.State != JobRunning
+}
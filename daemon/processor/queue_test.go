@@ -0,0 +1,245 @@
+package processor
+
+import (
+  "context"
+  "strconv"
+  "sync"
+  "testing"
+  "time"
+)
+
+/* blockingJob() returns a JobFunc that reports on started when it
+runs and then waits for release or its context to be canceled */
+func blockingJob(started chan<- string, name string, release <-chan struct{}) JobFunc {
+  return func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error) {
+    started<-name
+    select {
+      case <-release:
+        return &RunRecord{}, nil
+      case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+  }
+}
+
+func expectStarted(t *testing.T, started <-chan string, name string) {
+  t.Helper()
+  select {
+    case got := <-started:
+      if got != name {
+        t.Fatalf("Expected %s to start but %s did", name, got)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("Expected %s to start", name)
+  }
+}
+
+func expectNotStarted(t *testing.T, started <-chan string) {
+  t.Helper()
+  select {
+    case got := <-started:
+      t.Fatalf("Expected nothing to start but %s did", got)
+    case <-time.After(50 * time.Millisecond):
+  }
+}
+
+func TestQueueDriveSerialization(t *testing.T) {
+  q := NewJobQueue(4, nil)
+  started := make(chan string, 4)
+  release := make(chan struct{})
+
+  first := q.Enqueue("/a", "drive", ChangeTrigger, false, blockingJob(started, "a", release))
+  q.Enqueue("/b", "drive", ChangeTrigger, false, blockingJob(started, "b", release))
+  q.Enqueue("/c", "other", ChangeTrigger, false, blockingJob(started, "c", release))
+
+  // The other drive runs alongside while the second job waits its turn
+  got := map[string]bool{}
+  for i := 0; i < 2; i++ {
+    select {
+      case name := <-started:
+        got[name] = true
+      case <-time.After(time.Second):
+        t.Fatalf("Expected two jobs to run in parallel but got %v", got)
+    }
+  }
+  if !got["a"] || !got["c"] {
+    t.Fatalf("Expected a and c to run first but got %v", got)
+  }
+  expectNotStarted(t, started)
+
+  close(release)
+  expectStarted(t, started, "b")
+  if job, _ := q.Wait(first.ID); job.State != JobDone {
+    t.Errorf("Expected the first job to be done but it is %s", job.State)
+  }
+}
+
+func TestQueueRestoreWaitsForBackup(t *testing.T) {
+  q := NewJobQueue(2, nil)
+  started := make(chan string, 2)
+  release := make(chan struct{})
+
+  q.Enqueue("/a", "drive", ChangeTrigger, false, blockingJob(started, "backup", release))
+  expectStarted(t, started, "backup")
+  restore := q.EnqueueRestore("/a", "drive", blockingJob(started, "restore", release))
+  if restore.Kind != RestoreJob {
+    t.Errorf("Expected a restore job but got %s", restore.Kind)
+  }
+  expectNotStarted(t, started)
+  if job, ok := q.Active("/a"); !ok || job.Kind != BackupJob {
+    t.Errorf("Expected the backup to be the active job but got %+v", job)
+  }
+
+  close(release)
+  expectStarted(t, started, "restore")
+}
+
+func TestQueueDedup(t *testing.T) {
+  q := NewJobQueue(1, nil)
+  started := make(chan string, 4)
+  release := make(chan struct{})
+  defer close(release)
+
+  running := q.Enqueue("/a", "drive", ChangeTrigger, false, blockingJob(started, "running", release))
+  expectStarted(t, started, "running")
+
+  queued := q.Enqueue("/a", "drive", ChangeTrigger, false, blockingJob(started, "queued", release))
+  if queued.ID == running.ID {
+    t.Errorf("Expected a running job not to absorb new backups")
+  }
+  if again := q.Enqueue("/a", "drive", MountTrigger, false, blockingJob(started, "again", release)); again.ID != queued.ID {
+    t.Errorf("Expected the pending job %s to be reused but got %s", queued.ID, again.ID)
+  }
+  if forced := q.Enqueue("/a", "drive", ManualTrigger, true, blockingJob(started, "forced", release)); forced.ID == queued.ID {
+    t.Errorf("Expected a forced backup not to be merged with an unforced one")
+  }
+  if restore := q.EnqueueRestore("/a", "drive", blockingJob(started, "restore", release)); restore.ID == queued.ID {
+    t.Errorf("Expected restores never to be merged with backups")
+  }
+  if jobs := q.Jobs(); len(jobs) != 4 {
+    t.Errorf("Expected 4 jobs but got %d", len(jobs))
+  }
+}
+
+func TestQueueCancel(t *testing.T) {
+  q := NewJobQueue(1, nil)
+  started := make(chan string, 2)
+  release := make(chan struct{})
+  defer close(release)
+
+  running := q.Enqueue("/a", "drive", ChangeTrigger, false, blockingJob(started, "running", release))
+  expectStarted(t, started, "running")
+  queued := q.Enqueue("/b", "drive", ChangeTrigger, false, blockingJob(started, "queued", release))
+
+  // A queued job is dropped without ever running
+  job, err := q.Cancel(queued.ID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if job.State != JobCanceled || job.Started != nil || job.Error == nil || job.Error.Code != CanceledError {
+    t.Errorf("Expected the queued job to be canceled before starting but got %+v", job)
+  }
+
+  // A running job stops once its backup sees the canceled context
+  if job, err = q.Cancel(running.ID); err != nil {
+    t.Fatal(err)
+  }
+  if job.State != JobCanceled || job.Started == nil || job.Error == nil || job.Error.Code != CanceledError {
+    t.Errorf("Expected the running job to be canceled but got %+v", job)
+  }
+  expectNotStarted(t, started)
+
+  if _, err = q.Cancel("missing"); err == nil {
+    t.Errorf("Expected canceling an unknown job to fail")
+  }
+}
+
+func TestQueuePause(t *testing.T) {
+  q := NewJobQueue(2, nil)
+  started := make(chan string, 4)
+  busy, release := make(chan struct{}), make(chan struct{})
+  defer close(release)
+
+  q.Enqueue("/busy", "drive", ChangeTrigger, false, blockingJob(started, "busy", busy))
+  expectStarted(t, started, "busy")
+  q.Enqueue("/a", "drive", ChangeTrigger, false, blockingJob(started, "change", release))
+  q.Enqueue("/b", "drive", MountTrigger, false, blockingJob(started, "mount", release))
+
+  // Jobs queued before the pause wait for it to end
+  q.Pause("/a")
+  q.Pause("")
+  close(busy)
+  expectNotStarted(t, started)
+
+  q.Enqueue("/a", "other", ManualTrigger, true, blockingJob(started, "manual", release))
+  expectStarted(t, started, "manual")
+
+  // Resuming everything also resumes /a
+  q.Resume("")
+  expectStarted(t, started, "change")
+}
+
+func TestQueueHistoryLimit(t *testing.T) {
+  defer func(limit int) { JobHistoryLimit = limit }(JobHistoryLimit)
+  JobHistoryLimit = 3
+
+  q := NewJobQueue(2, nil)
+  ids := make([]string, 0)
+  for i := 0; i < 6; i++ {
+    root := "/root"+strconv.Itoa(i)
+    job := q.Enqueue(root, root, ManualTrigger, true, func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error) {
+      return &RunRecord{}, nil
+    })
+    if _, err := q.Wait(job.ID); err != nil {
+      t.Fatal(err)
+    }
+    ids = append(ids, job.ID)
+  }
+
+  jobs := q.Jobs()
+  if len(jobs) != JobHistoryLimit {
+    t.Fatalf("Expected %d remembered jobs but got %d", JobHistoryLimit, len(jobs))
+  }
+  for i, job := range jobs {
+    if job.ID != ids[len(ids) - JobHistoryLimit + i] {
+      t.Errorf("Expected the newest jobs to be remembered but got %s", job.ID)
+    }
+  }
+  if _, err := q.Get(ids[0]); err == nil {
+    t.Errorf("Expected the oldest job to be forgotten")
+  }
+}
+
+// Many jobs of a few drives never overlap on a drive
+func TestQueueConcurrency(t *testing.T) {
+  q := NewJobQueue(4, nil)
+  var mutex sync.Mutex
+  busy := make(map[string]bool)
+
+  ids := make([]string, 0)
+  for i := 0; i < 40; i++ {
+    root := "/root"+strconv.Itoa(i)
+    drive := "drive"+strconv.Itoa(i % 3)
+    job := q.Enqueue(root, drive, ChangeTrigger, false, func(ctx context.Context, progress chan<- BackupProgress) (*RunRecord, error) {
+      mutex.Lock()
+      if busy[drive] {
+        t.Errorf("Expected only one job on %s at a time", drive)
+      }
+      busy[drive] = true
+      mutex.Unlock()
+
+      time.Sleep(time.Millisecond)
+
+      mutex.Lock()
+      busy[drive] = false
+      mutex.Unlock()
+      return &RunRecord{}, nil
+    })
+    ids = append(ids, job.ID)
+  }
+  for _, id := range ids {
+    if job, err := q.Wait(id); err != nil || job.State != JobDone {
+      t.Errorf("Expected job %s to be done but got %+v: %v", id, job, err)
+    }
+  }
+}
@@ -0,0 +1,57 @@
+package processor
+
+import (
+  "runtime"
+  "syscall"
+  "fmt"
+)
+
+/* runAs() calls fn with the file system permissions of uid and gid
+and no supplementary groups so it can only touch what that user
+could, whatever happens to the paths it was given after they were
+checked. The ids are only changed on a thread of its own which is
+thrown away afterwards. uid 0 simply calls fn */
+func runAs(uid uint32, gid uint32, fn func() error) error {
+  if uid == 0 {
+    return fn()
+  }
+
+  result := make(chan error, 1)
+  go func() {
+    // Never unlocked so the thread exits along with the goroutine
+    runtime.LockOSThread()
+    defer func() {
+      if r := recover(); r != nil {
+        result<-fmt.Errorf("Panicked as uid %d in runAs(): %v", uid, r)
+      }
+    }()
+    if err := becomeUser(uid, gid); err != nil {
+      result<-err
+      return
+    }
+    result<-fn()
+  }()
+  return <-result
+}
+
+/* becomeUser() switches the file system ids of the current thread.
+The raw system calls only affect this thread unlike syscall.Setgroups()
+which changes every thread of the process. Changing the uid last also
+drops the capabilities that let root ignore file permissions */
+func becomeUser(uid uint32, gid uint32) error {
+  if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGROUPS, 0, 0, 0); errno != 0 {
+    return fmt.Errorf("Failed to drop groups in becomeUser(): %v", errno)
+  }
+  // setfsuid() and setfsgid() return the previous id instead of failing
+  syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+  syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+  current, _, _ := syscall.RawSyscall(syscall.SYS_SETFSGID, ^uintptr(0), 0, 0)
+  if uint32(current) != gid {
+    return fmt.Errorf("Failed to become gid %d in becomeUser()", gid)
+  }
+  current, _, _ = syscall.RawSyscall(syscall.SYS_SETFSUID, ^uintptr(0), 0, 0)
+  if uint32(current) != uid {
+    return fmt.Errorf("Failed to become uid %d in becomeUser()", uid)
+  }
+  return nil
+}
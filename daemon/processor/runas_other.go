@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package processor
+
+import (
+  "fmt"
+)
+
+// File system ids can only be switched per thread on linux
+func runAs(uid uint32, gid uint32, fn func() error) error {
+  if uid == 0 {
+    return fn()
+  }
+  return fmt.Errorf("Can't act as uid %d on this platform in runAs()", uid)
+}
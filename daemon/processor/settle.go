@@ -0,0 +1,81 @@
+package processor
+
+import (
+  "fmt"
+  "sort"
+  "time"
+)
+
+// Settle windows of roots that don't set their own
+var (
+  DefaultSettleQuiet time.Duration = 2 * time.Second
+  DefaultSettleMaxDelay time.Duration = 30 * time.Second
+)
+
+/* effective() fills in the defaults of a policy. A quiet window
+longer than the default cap is never cut short by that cap */
+func (s SettlePolicy) effective() SettlePolicy {
+  if s.Quiet == 0 {
+    s.Quiet = DefaultSettleQuiet
+  }
+  if s.MaxDelay == 0 {
+    s.MaxDelay = DefaultSettleMaxDelay
+    if s.MaxDelay < s.Quiet {
+      s.MaxDelay = s.Quiet
+    }
+  }
+  return s
+}
+
+func validateSettle(policy SettlePolicy) error {
+  if policy.Quiet < 0 || policy.MaxDelay < 0 {
+    return fmt.Errorf("Settle windows can't be negative")
+  }
+  if policy.Quiet != 0 && policy.MaxDelay != 0 && policy.MaxDelay < policy.Quiet {
+    return fmt.Errorf("Maximum delay %v is shorter than the quiet window %v", policy.MaxDelay, policy.Quiet)
+  }
+  return nil
+}
+
+/* settler holds back backups of changed roots until they settle.
+first and last are when the oldest and newest unhandled changes of
+each root were seen */
+type settler struct {
+  first map[string]time.Time
+  last map[string]time.Time
+}
+
+func newSettler() *settler {
+  return &settler{
+    first: make(map[string]time.Time),
+    last: make(map[string]time.Time),
+  }
+}
+
+// changed() notes that root changed at now
+func (s *settler) changed(root string, now time.Time) {
+  if _, ok := s.first[root]; !ok {
+    s.first[root] = now
+  }
+  s.last[root] = now
+}
+
+/* settled() returns and forgets every root that settled by now
+according to its policy. Roots policy fails on are forgotten too */
+func (s *settler) settled(now time.Time, policy func(string) (SettlePolicy, error)) []string {
+  roots := make([]string, 0)
+  for root, first := range s.first {
+    settle, err := policy(root)
+    if err == nil {
+      settle = settle.effective()
+      if now.Sub(s.last[root]) < settle.Quiet && now.Sub(first) < settle.MaxDelay {
+        continue
+      }
+      roots = append(roots, root)
+    }
+    delete(s.first, root)
+    delete(s.last, root)
+  }
+  sort.Strings(roots)
+  return roots
+}
@@ -8,75 +8,131 @@ import (
 
 var PollSpeed time.Duration = time.Second
 
-func MonitorSystem(mdb MetadataDB, c chan<- string) {
+/* MonitorSystem() requests backups of roots whose drive was just
+mounted or that changed and then settled according to their
+SettlePolicy. Changes and mounts are also published on events along
+with drives being unmounted */
+func MonitorSystem(mdb MetadataDB, events *EventBus, c chan<- Request) {
   defer close(c)
 
-  NextChangeTimeout = time.Second
-  watching := make(map[string]bool)
+  NextChangeTimeout = PollSpeed
+  watching := make(map[string]DetectionMode)
   mounted := make(map[string]bool)
+  settling := newSettler()
   detector := newFsDetector()
   pollForNewBackups(mdb, watching, detector)
 
   for {
-    // Check for any changes to backup points
-    changeRoot, err := detector.NextChange()
-    _, isTimeout := err.(*TimeoutErr)
-    if !isTimeout {
+    // Record every change to backup points in their change sets
+    for root, changes := range collectChanges(detector) {
+      wasUnchanged, err := recordChanges(root, NewChangeSet(root, changes), mdb)
       if err != nil {
-        log.Printf("Failed to receive next change in MonitorSystem(): %v", err)
-      } else {
-        row, err := mdb.GetRow(changeRoot)
-        if err != nil {
-          log.Printf("Failed to retrieve row in MonitorSystem(): %v", err)
-        } else if !row.HasChanged {
-          row.HasChanged = true
-          err = mdb.UpdateRow(row)
-          if err != nil {
-            log.Printf("Failed to update row in MonitorSystem(): %v", err)
-          } else {
-            backupCmd := string(BackupCommand)+":"+changeRoot
-            c<-backupCmd
-          }
-        }
+        log.Printf("Failed to record changes of %s in MonitorSystem(): %v", root, err)
+        continue
+      }
+      if wasUnchanged {
+        events.Publish(Event{Type: ChangeDetectedEvent, Root: root})
       }
+      settling.changed(root, time.Now())
+    }
+
+    // Back up roots once writes to them have died down
+    for _, root := range settling.settled(time.Now(), settlePolicy(mdb)) {
+      requestBackup(c, root, ChangeTrigger)
     }
 
     // Check for any new backups created
     pollForNewBackups(mdb, watching, detector)
 
     // Check if backup reflections are mounted
-    newlyMounted := pollForNewDrives(mdb, mounted)
+    newlyMounted := pollForNewDrives(mdb, mounted, events)
     for _, origRoot := range newlyMounted {
-      backupCmd := string(BackupCommand)+":"+origRoot
-      c<-backupCmd
+      requestBackup(c, origRoot, MountTrigger)
+    }
+  }
+}
+
+/* collectChanges() groups changes by root until none arrive for
+NextChangeTimeout or changes have kept arriving for PollSpeed */
+func collectChanges(detector *fsDetector) map[string][]Change {
+  changes := make(map[string][]Change)
+  start := time.Now()
+  for time.Since(start) < PollSpeed {
+    change, err := detector.NextChange()
+    if _, isTimeout := err.(*TimeoutErr); isTimeout {
+      break
+    } else if err != nil {
+      log.Printf("Failed to receive next change in collectChanges(): %v", err)
+      break
     }
+    changes[change.Root] = append(changes[change.Root], change)
+  }
+  return changes
+}
 
-    // Wait to check again
-    <-time.After(PollSpeed)
+// settlePolicy() looks up the SettlePolicy of roots in mdb
+func settlePolicy(mdb MetadataDB) func(string) (SettlePolicy, error) {
+  return func(root string) (SettlePolicy, error) {
+    mdbRow, err := mdb.GetRow(root)
+    return mdbRow.Settle, err
   }
 }
 
-func pollForNewBackups(mdb MetadataDB, watching map[string]bool, detector *fsDetector) {
+func requestBackup(c chan<- Request, origRoot string, trigger BackupTrigger) {
+  req, err := NewRequest("", BackupCommand, BackupArgs{Root: origRoot, Trigger: trigger})
+  if err != nil {
+    log.Printf("Failed to create backup request in requestBackup(): %v", err)
+    return
+  }
+  c<-req
+}
+
+/* pollForNewBackups() keeps the detector in step with the roots in
+mdb and the change detection each of them asked for */
+func pollForNewBackups(mdb MetadataDB, watching map[string]DetectionMode, detector *fsDetector) {
   keys := mdb.Keys()
   for _, key := range keys {
-    if watching[key] == false {
-      err := detector.Watch(key)
-      if err != nil {
-        log.Printf("Failed to set watch on %s in pollForNewBackups(): %v", key, err)
+    mdbRow, err := mdb.GetRow(key)
+    if err != nil {
+      log.Printf("Failed to get row in pollForNewBackups(): %v", err)
+      continue
+    }
+    mode := mdbRow.Detection
+    if mode == "" {
+      mode = AutoDetection
+    }
+    current, ok := watching[key]
+    if ok && current == mode {
+      continue
+    }
+
+    if ok {
+      if err = detector.Unwatch(key); err != nil {
+        log.Printf("Failed to unwatch %s in pollForNewBackups(): %v", key, err)
         continue
       }
-      watching[key] = true
+      delete(watching, key)
+    }
+    if mode == PollDetection {
+      err = detector.Poll(key)
+    } else {
+      err = detector.Watch(key)
+    }
+    if err != nil {
+      log.Printf("Failed to set watch on %s in pollForNewBackups(): %v", key, err)
+      continue
     }
+    watching[key] = mode
   }
 
-  for key, watched := range watching {
-    if watched && !contains(keys, key) {
+  for key := range watching {
+    if !contains(keys, key) {
       err := detector.Unwatch(key)
       if err != nil {
         log.Printf("Failed to unwatch %s in pollForNewBackups(): %v", key, err)
         continue
       }
-      watching[key] = false
+      delete(watching, key)
     }
   }
 }
@@ -90,7 +146,7 @@ func contains(slice []string, key string) bool {
   return false
 }
 
-func pollForNewDrives(mdb MetadataDB, mounted map[string]bool) []string {
+func pollForNewDrives(mdb MetadataDB, mounted map[string]bool, events *EventBus) []string {
   newMounts := make([]string, 0)
   for _, key := range mdb.Keys() {
     row, err  := mdb.GetRow(key)
@@ -104,21 +160,25 @@ func pollForNewDrives(mdb MetadataDB, mounted map[string]bool) []string {
     if !isMounted && mountPoint != "" {
       mounted[key] = true
       refRoot := filepath.Join(mountPoint, row.ReflectionBase)
-      row.ReflectionRoot = refRoot
-      err = mdb.UpdateRow(row)
+      err = modifyRow(key, mdb, func(row *MDBRow) {
+        row.ReflectionRoot = refRoot
+      })
       if err != nil {
         log.Printf("Failed to update row for %s in pollForNewDrives(): %v", key, err)
         continue
       }
+      events.Publish(Event{Type: DriveMountedEvent, Root: key, Drive: row.DriveLabel})
       newMounts = append(newMounts, key)
     } else if isMounted && mountPoint == "" {
-      row.ReflectionRoot = ""
-      err = mdb.UpdateRow(row)
+      err = modifyRow(key, mdb, func(row *MDBRow) {
+        row.ReflectionRoot = ""
+      })
       if err != nil {
         log.Printf("Failed to update row for %s in pollForNewDrives(): %v", key, err)
         continue
       }
       delete(mounted, key)
+      events.Publish(Event{Type: DriveUnmountedEvent, Root: key, Drive: row.DriveLabel})
     }
   }
 
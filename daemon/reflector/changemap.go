@@ -0,0 +1,147 @@
+package reflector
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "context"
+  "encoding/json"
+  "encoding/hex"
+  "crypto/sha1"
+  "path/filepath"
+  "io/ioutil"
+  "sort"
+  "syscall"
+  "fmt"
+  "os"
+  "io"
+)
+
+const (
+  SHA1ChangeMapCode processor.ChangeMapCode = "cm1"
+)
+
+// Name of the manifest kept at the top of a reflection
+var ChangeMapFile string = ".gobackcm"
+
+type SHA1ChangeMap struct {
+  MapCode processor.ChangeMapCode `json:"code"`
+  Hashes map[string]string `json:"hashes"`
+}
+
+/* NewSHA1ChangeMap() walks root and records the SHA1 of every
+regular file keyed by its path relative to root. Symlinks, fifos,
+sockets and devices are skipped to match linkSyncDir(). Hashing stops
+once ctx is done, even in the middle of a file */
+func NewSHA1ChangeMap(ctx context.Context, root string) (processor.ChangeMap, error) {
+  cm := &SHA1ChangeMap{
+    MapCode: SHA1ChangeMapCode,
+    Hashes: make(map[string]string),
+  }
+
+  err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    if err = ctx.Err(); err != nil {
+      return err
+    }
+    rel, err := filepath.Rel(root, path)
+    if err != nil {
+      return err
+    }
+    if rel == "." || skipped(fi) {
+      return nil
+    }
+    if rel == ChangeMapFile {
+      return nil
+    }
+
+    if fi.IsDir() {
+      cm.Hashes[rel] = ""
+      return nil
+    }
+    hash, err := hashFile(ctx, path)
+    if err != nil {
+      return err
+    }
+    cm.Hashes[rel] = hash
+    return nil
+  })
+
+  if err != nil {
+    return nil, fmt.Errorf("Couldn't walk %s in NewSHA1ChangeMap(): %w", root, err)
+  }
+  return cm, nil
+}
+
+/* LoadSHA1ChangeMap() reads a change map previously written
+with SHA1ChangeMap.Save() */
+func LoadSHA1ChangeMap(mapFile string) (processor.ChangeMap, error) {
+  serial, err := ioutil.ReadFile(mapFile)
+  if err != nil {
+    return nil, err
+  }
+
+  cm := &SHA1ChangeMap{}
+  if err = json.Unmarshal(serial, cm); err != nil {
+    return nil, fmt.Errorf("Failed to parse %s in LoadSHA1ChangeMap(): %v", mapFile, err)
+  }
+  if cm.MapCode != SHA1ChangeMapCode {
+    return nil, fmt.Errorf("Unexpected change map code %s in LoadSHA1ChangeMap()", cm.MapCode)
+  }
+  if cm.Hashes == nil {
+    cm.Hashes = make(map[string]string)
+  }
+  return cm, nil
+}
+
+func (s *SHA1ChangeMap) Code() processor.ChangeMapCode {
+  return s.MapCode
+}
+
+func (s *SHA1ChangeMap) Lookup(path string) (string, bool) {
+  hash, ok := s.Hashes[path]
+  return hash, ok
+}
+
+// Paths are sorted so parent directories always come before their contents
+func (s *SHA1ChangeMap) Paths() []string {
+  paths := make([]string, 0, len(s.Hashes))
+  for path, _ := range s.Hashes {
+    paths = append(paths, path)
+  }
+  sort.Strings(paths)
+  return paths
+}
+
+func (s *SHA1ChangeMap) Save(mapFile string) error {
+  serial, err := json.Marshal(s)
+  if err != nil {
+    return fmt.Errorf("Failed to serialize change map in SHA1ChangeMap.Save(): %v", err)
+  }
+  err = WriteFileAtomic(mapFile, serial, 0644)
+  if err != nil {
+    return fmt.Errorf("Failed to write %s in SHA1ChangeMap.Save(): %v", mapFile, err)
+  }
+  return nil
+}
+
+/* hashFile() opens path the way copyFile() does so a symlink or fifo
+swapped in after the walk is refused instead of followed or waited on */
+func hashFile(ctx context.Context, path string) (string, error) {
+  in, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+  if err != nil {
+    return "", err
+  }
+  defer in.Close()
+  if fi, err := in.Stat(); err != nil {
+    return "", err
+  } else if !fi.Mode().IsRegular() {
+    return "", fmt.Errorf("%s is not a regular file", path)
+  }
+
+  h := sha1.New()
+  if _, err = io.Copy(h, ctxReader{ctx, in}); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,110 +1,81 @@
 package reflector
 
 import (
+  "context"
   "io/ioutil"
   "path/filepath"
   "fmt"
+  "syscall"
   "os"
   "io"
 )
-// CopyFile copies the contents of the file named src to the file named
-// by dst. The file will be created if it does not already exist. If the
-// destination file exists, all it's contents will be replaced by the contents
-// of the source file. The file mode will be copied from the source and
-// the copied data is synced/flushed to stable storage.
-func copyFile(src, dst string) (err error) {
-	in, err := os.Open(src)
-	if err != nil {
-		return
-	}
-	defer in.Close()
 
-	out, err := os.Create(dst)
-	if err != nil {
-		return
-	}
-	defer func() {
-		if e := out.Close(); e != nil {
-			err = e
-		}
-	}()
+/* copyFile() copies the regular file src to dst through a temporary
+file next to dst that is renamed over it, so readers never see a half
+written file and a directory at dst is replaced. Neither side follows
+symlinks. src is opened with O_NOFOLLOW (and O_NONBLOCK so a fifo
+swapped in after the walk can't hold up the backup) and checked
+through the open file, and the temporary file is created exclusively
+under a random name. A symlink planted at either path therefore can't
+redirect the copy. The file mode is copied from the source and the
+data is synced to storage. The copy stops with ctx.Err() once ctx
+is done */
+func copyFile(ctx context.Context, src, dst string) (err error) {
+  in, err := os.OpenFile(src, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+  if err != nil {
+    return
+  }
+  defer in.Close()
+  si, err := in.Stat()
+  if err != nil {
+    return
+  }
+  if !si.Mode().IsRegular() {
+    return fmt.Errorf("%s is not a regular file", src)
+  }
 
-	_, err = io.Copy(out, in)
-	if err != nil {
-		return
-	}
+  out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*"+tempSuffix)
+  if err != nil {
+    return
+  }
+  tmp := out.Name()
+  defer func() {
+    if err != nil {
+      out.Close()
+      os.Remove(tmp)
+    }
+  }()
 
-	err = out.Sync()
-	if err != nil {
-		return
-	}
+  if _, err = io.Copy(out, ctxReader{ctx, in}); err != nil {
+    return
+  }
+  if err = out.Chmod(si.Mode()); err != nil {
+    return
+  }
+  if err = out.Sync(); err != nil {
+    return
+  }
+  if err = out.Close(); err != nil {
+    return
+  }
 
-	si, err := os.Stat(src)
-	if err != nil {
-		return
-	}
-	err = os.Chmod(dst, si.Mode())
-	if err != nil {
-		return
-	}
-
-	return
+  if di, lerr := os.Lstat(dst); lerr == nil && di.IsDir() {
+    if err = os.RemoveAll(dst); err != nil {
+      return
+    }
+  }
+  return os.Rename(tmp, dst)
 }
 
-// CopyDir recursively copies a directory tree, attempting to preserve permissions.
-// Source directory must exist, destination directory must *not* exist.
-// Symlinks are ignored and skipped.
-func copyDir(src string, dst string) (err error) {
-	src = filepath.Clean(src)
-	dst = filepath.Clean(dst)
-
-	si, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
-	if !si.IsDir() {
-		return fmt.Errorf("source is not a directory")
-	}
-
-	_, err = os.Stat(dst)
-	if err != nil && !os.IsNotExist(err) {
-		return
-	}
-	if err == nil {
-		return fmt.Errorf("destination already exists")
-	}
-
-	err = os.MkdirAll(dst, si.Mode())
-	if err != nil {
-		return
-	}
-
-	entries, err := ioutil.ReadDir(src)
-	if err != nil {
-		return
-	}
-
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			err = copyDir(srcPath, dstPath)
-			if err != nil {
-				return
-			}
-		} else {
-			// Skip symlinks.
-			if entry.Mode()&os.ModeSymlink != 0 {
-				continue
-			}
-
-			err = copyFile(srcPath, dstPath)
-			if err != nil {
-				return
-			}
-		}
-	}
+// ctxReader stops reading with ctx.Err() once ctx is done
+type ctxReader struct {
+  ctx context.Context
+  r io.Reader
+}
 
-	return
+func (c ctxReader) Read(p []byte) (int, error) {
+  if err := c.ctx.Err(); err != nil {
+    return 0, err
+  }
+  return c.r.Read(p)
 }
@@ -0,0 +1,240 @@
+package reflector
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "context"
+  "path/filepath"
+  "fmt"
+  "log"
+  "os"
+)
+
+type ChangeMapCreator func(context.Context, string) (processor.ChangeMap, error)
+type ChangeMapLoader func(string) (processor.ChangeMap, error)
+
+type ChangeMapReflector struct {
+  originalDirectory string
+  reflectingDirectory string
+  createMap ChangeMapCreator
+  loadMap ChangeMapLoader
+  track *tracker
+  updates chan<- processor.BackupProgress
+}
+
+// Satisfies interactor.reflectorCreator
+func NewSHA1Reflector(original, reflecting string) (processor.Reflector, error) {
+  cr := ChangeMapReflector{
+    originalDirectory: original,
+    reflectingDirectory: reflecting,
+    createMap: NewSHA1ChangeMap,
+    loadMap: LoadSHA1ChangeMap,
+  }
+  return &cr, nil
+}
+
+/* ChangeMapReflector.Backup() builds a change map of the original
+directory and compares it against the one saved in the reflection
+by the previous backup. Only files whose content hash differs are
+copied so touched mtimes and clock skew don't matter. Without a
+manifest the reflection is hashed instead. Content the reflection
+already holds under another path, such as a renamed or moved file,
+is linked from there instead of copied */
+func (c *ChangeMapReflector) Backup(ctx context.Context) error {
+  c.track = newTracker(c.updates)
+  err := recoverStaging(c.reflectingDirectory)
+  if err != nil {
+    return fmt.Errorf("Couldn't recover previous backup in ChangeMapReflector.Backup(): %v", err)
+  }
+  if err = c.track.scan(ctx, c.originalDirectory); err != nil {
+    return fmt.Errorf("Couldn't scan original in ChangeMapReflector.Backup(): %w", err)
+  }
+
+  current, err := c.createMap(ctx, c.originalDirectory)
+  if err != nil {
+    return fmt.Errorf("Couldn't create change map in ChangeMapReflector.Backup(): %w", err)
+  }
+
+  mapFile := filepath.Join(c.reflectingDirectory, ChangeMapFile)
+  previous, err := c.loadMap(mapFile)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      log.Printf("Ignoring unreadable change map in ChangeMapReflector.Backup(): %v", err)
+    }
+    previous = nil
+  } else if previous.Code() != current.Code() {
+    previous = nil
+  }
+  if previous == nil {
+    // Without a manifest the reflection itself is compared
+    if _, err = os.Stat(c.reflectingDirectory); err == nil {
+      if previous, err = c.createMap(ctx, c.reflectingDirectory); err != nil {
+        return fmt.Errorf("Couldn't hash reflection in ChangeMapReflector.Backup(): %w", err)
+      }
+    }
+  }
+  /* The manifest only describes the reflection until this backup
+  changes it, so it is removed until the backup is complete. A backup
+  that is interrupted leaves no manifest behind and the next one
+  compares against the reflection instead of trusting stale hashes */
+  if err = os.Remove(mapFile); err == nil {
+    err = syncParent(mapFile)
+  }
+  if err != nil && !os.IsNotExist(err) {
+    return fmt.Errorf("Couldn't remove change map in ChangeMapReflector.Backup(): %v", err)
+  }
+
+  si, err := os.Stat(c.originalDirectory)
+  if err != nil {
+    return fmt.Errorf("Couldn't stat original in ChangeMapReflector.Backup(): %v", err)
+  }
+  if err = os.MkdirAll(c.reflectingDirectory, si.Mode()); err != nil {
+    return fmt.Errorf("Couldn't create reflection in ChangeMapReflector.Backup(): %v", err)
+  }
+
+  reusable := reusableContent(previous, current)
+  for _, path := range current.Paths() {
+    if err = ctx.Err(); err != nil {
+      return err
+    }
+    hash, _ := current.Lookup(path)
+    err = reflectMapEntry(ctx, path, hash, c.originalDirectory, c.reflectingDirectory, previous, reusable, c.track)
+    if err != nil {
+      return fmt.Errorf("Couldn't reflect %s in ChangeMapReflector.Backup(): %v", path, err)
+    }
+  }
+
+  if err = removeUnmapped(c.reflectingDirectory, current); err != nil {
+    return fmt.Errorf("Couldn't remove stale files in ChangeMapReflector.Backup(): %v", err)
+  }
+
+  if err = current.Save(mapFile); err != nil {
+    return fmt.Errorf("Couldn't save change map in ChangeMapReflector.Backup(): %v", err)
+  }
+  c.track.finish()
+  return nil
+}
+
+func (c ChangeMapReflector) Stats() processor.BackupStats {
+  return c.track.counted()
+}
+
+func (c *ChangeMapReflector) ReportProgress(ch chan<- processor.BackupProgress) {
+  c.updates = ch
+}
+
+/* reusableContent() maps content hashes to a path in the reflection
+that holds them and keeps holding them for the whole backup. Those
+are files that the backup either leaves alone or deletes at the end */
+func reusableContent(previous processor.ChangeMap, current processor.ChangeMap) map[string]string {
+  reusable := make(map[string]string)
+  if previous == nil {
+    return reusable
+  }
+  for _, path := range previous.Paths() {
+    hash, _ := previous.Lookup(path)
+    if hash == "" {
+      continue
+    }
+    if now, ok := current.Lookup(path); !ok || now == hash {
+      reusable[hash] = path
+    }
+  }
+  return reusable
+}
+
+func reflectMapEntry(ctx context.Context, path string, hash string, origRoot string, refRoot string, previous processor.ChangeMap, reusable map[string]string, t *tracker) error {
+  src := filepath.Join(origRoot, path)
+  dst := filepath.Join(refRoot, path)
+  si, err := os.Stat(src)
+  if err != nil {
+    return err
+  }
+  di, dstErr := os.Lstat(dst)
+
+  if si.IsDir() {
+    if dstErr == nil && di.IsDir() {
+      return nil
+    }
+    if err = os.RemoveAll(dst); err != nil {
+      return err
+    }
+    return os.MkdirAll(dst, si.Mode())
+  }
+
+  t.file(src)
+  if dstErr == nil && di.Mode().IsRegular() && di.Size() == si.Size() && previous != nil {
+    prevHash, ok := previous.Lookup(path)
+    if ok && prevHash == hash {
+      t.done(si.Size(), false)
+      return nil
+    }
+  }
+  if other, ok := reusable[hash]; ok && other != path {
+    if reused, err := reuseContent(ctx, filepath.Join(refRoot, other), dst, si.Size()); err != nil {
+      return err
+    } else if reused {
+      t.done(si.Size(), false)
+      return nil
+    }
+  }
+  if err = copyFile(ctx, src, dst); err != nil {
+    return err
+  }
+  t.done(si.Size(), true)
+  return nil
+}
+
+/* reuseContent() replaces dst with a hard link to other, or a copy
+of it where the drive doesn't support hard links. It reports false
+without an error when other is missing or no longer the right size */
+func reuseContent(ctx context.Context, other string, dst string, size int64) (bool, error) {
+  oi, err := os.Lstat(other)
+  if err != nil || !oi.Mode().IsRegular() || oi.Size() != size {
+    return false, nil
+  }
+
+  tmp := dst+tempSuffix
+  os.Remove(tmp)
+  if err = os.Link(other, tmp); err != nil {
+    return true, copyFile(ctx, other, dst)
+  }
+  if di, err := os.Lstat(dst); err == nil && di.IsDir() {
+    if err = os.RemoveAll(dst); err != nil {
+      os.Remove(tmp)
+      return false, err
+    }
+  }
+  if err = os.Rename(tmp, dst); err != nil {
+    os.Remove(tmp)
+    return false, err
+  }
+  return true, nil
+}
+
+/* removeUnmapped() deletes everything in the reflection that
+is not part of the change map */
+func removeUnmapped(refRoot string, cm processor.ChangeMap) error {
+  return filepath.Walk(refRoot, func(path string, fi os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    rel, err := filepath.Rel(refRoot, path)
+    if err != nil {
+      return err
+    }
+    if rel == "." || rel == ChangeMapFile {
+      return nil
+    }
+
+    if _, ok := cm.Lookup(rel); ok {
+      return nil
+    }
+    if err = os.RemoveAll(path); err != nil {
+      return err
+    }
+    if fi.IsDir() {
+      return filepath.SkipDir
+    }
+    return nil
+  })
+}
@@ -0,0 +1,304 @@
+package reflector
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "context"
+  "io/ioutil"
+  "path/filepath"
+  "fmt"
+  "os"
+)
+
+type IncrementalReflector struct {
+  originalDirectory string
+  reflectingDirectory string
+  track *tracker
+  updates chan<- processor.BackupProgress
+  changes *processor.ChangeSet
+}
+
+// Satisfies interactor.reflectorCreator
+func NewIncrementalReflector(original, reflecting string) (processor.Reflector, error) {
+  ir := IncrementalReflector{
+    originalDirectory: original,
+    reflectingDirectory: reflecting,
+  }
+  return &ir, nil
+}
+
+/* IncrementalReflector.Backup() walks the original and reflecting
+directories side by side. Files that are new or whose size or
+modification time differ are copied over and anything that no longer
+exists in the original is removed. The end state is the same as
+PlainReflector.Backup() but untouched files are never rewritten.
+Each file is replaced atomically so an interrupted backup only ever
+leaves a mix of old and new whole files. After SetChanges() only the
+changed paths are looked at unless there is no reflection yet */
+func (i *IncrementalReflector) Backup(ctx context.Context) error {
+  i.track = newTracker(i.updates)
+  changes := i.changes
+  i.changes = nil
+  err := recoverStaging(i.reflectingDirectory)
+  if err != nil {
+    return fmt.Errorf("Couldn't recover previous backup in IncrementalReflector.Backup(): %v", err)
+  }
+  // Changes only make sense on top of an existing reflection
+  if _, err = os.Stat(i.reflectingDirectory); changes != nil && err == nil {
+    if err = syncChanges(ctx, i.originalDirectory, i.reflectingDirectory, *changes, i.track); err != nil {
+      return fmt.Errorf("Couldn't sync changes in IncrementalReflector.Backup(): %w", err)
+    }
+    i.track.finish()
+    return nil
+  }
+  if err = i.track.scan(ctx, i.originalDirectory); err != nil {
+    return fmt.Errorf("Couldn't scan original in IncrementalReflector.Backup(): %w", err)
+  }
+
+  err = syncDir(ctx, i.originalDirectory, i.reflectingDirectory, i.track)
+  if err != nil {
+    return fmt.Errorf("Couldn't sync directories in IncrementalReflector.Backup(): %w", err)
+  }
+  i.track.finish()
+  return nil
+}
+
+// SetChanges() limits the next Backup() to the paths of changes
+func (i *IncrementalReflector) SetChanges(changes processor.ChangeSet) {
+  i.changes = &changes
+}
+
+func (i IncrementalReflector) Stats() processor.BackupStats {
+  return i.track.counted()
+}
+
+func (i *IncrementalReflector) ReportProgress(c chan<- processor.BackupProgress) {
+  i.updates = c
+}
+
+// Every file syncDir() goes through is counted by t
+func syncDir(ctx context.Context, src string, dst string, t *tracker) error {
+  return linkSyncDir(ctx, src, dst, "", t)
+}
+
+/* linkSyncDir() is syncDir() except that files which are unchanged
+in the link directory are hard linked from there instead of copied.
+Both stop between files once ctx is done */
+func linkSyncDir(ctx context.Context, src string, dst string, link string, t *tracker) error {
+  si, err := os.Stat(src)
+  if err != nil {
+    return err
+  }
+  if !si.IsDir() {
+    return fmt.Errorf("source %s is not a directory", src)
+  }
+
+  di, err := os.Lstat(dst)
+  if err == nil && !di.IsDir() {
+    if err = os.Remove(dst); err != nil {
+      return err
+    }
+  } else if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  if err = os.MkdirAll(dst, si.Mode()); err != nil {
+    return err
+  }
+
+  srcEntries, err := ioutil.ReadDir(src)
+  if err != nil {
+    return err
+  }
+  dstEntries, err := ioutil.ReadDir(dst)
+  if err != nil {
+    return err
+  }
+
+  existing := make(map[string]os.FileInfo)
+  for _, entry := range dstEntries {
+    existing[entry.Name()] = entry
+  }
+
+  for _, entry := range srcEntries {
+    if err = ctx.Err(); err != nil {
+      return err
+    }
+    srcPath := filepath.Join(src, entry.Name())
+    dstPath := filepath.Join(dst, entry.Name())
+
+    if skipped(entry) {
+      continue
+    }
+    reflected, ok := existing[entry.Name()]
+    delete(existing, entry.Name())
+
+    linkPath := ""
+    if link != "" {
+      linkPath = filepath.Join(link, entry.Name())
+    }
+
+    if entry.IsDir() {
+      if err = linkSyncDir(ctx, srcPath, dstPath, linkPath, t); err != nil {
+        return err
+      }
+      continue
+    }
+
+    t.file(srcPath)
+    if ok && !fileChanged(entry, reflected) {
+      t.done(entry.Size(), false)
+      continue
+    }
+    if linkPath != "" {
+      linked, err := linkUnchanged(linkPath, dstPath, entry)
+      if err != nil {
+        return err
+      }
+      if linked {
+        t.done(entry.Size(), false)
+        continue
+      }
+    }
+    if err = copyFileWithTimes(ctx, srcPath, dstPath, entry); err != nil {
+      return err
+    }
+    t.done(entry.Size(), true)
+  }
+
+  // Whatever is left no longer exists in the original
+  for name, _ := range existing {
+    if err = os.RemoveAll(filepath.Join(dst, name)); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+/* syncChanges() brings every changed path of the reflection up to
+date with the original. Paths that no longer exist in the original
+are removed and changed directories are synced whole */
+func syncChanges(ctx context.Context, src string, dst string, changes processor.ChangeSet, t *tracker) error {
+  // Directories are synced whole so nothing below them is needed
+  dirs := make(map[string]bool)
+  paths := make([]string, 0, len(changes.Paths))
+  for _, path := range changes.Sorted() {
+    if hasParentIn(path, dirs) {
+      continue
+    }
+    if si, err := os.Lstat(filepath.Join(src, path)); err == nil && si.IsDir() {
+      dirs[path] = true
+    }
+    paths = append(paths, path)
+  }
+
+  scanned := make([]string, 0, len(paths))
+  for _, path := range paths {
+    scanned = append(scanned, filepath.Join(src, path))
+  }
+  if err := t.scan(ctx, scanned...); err != nil {
+    return err
+  }
+
+  for _, path := range paths {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+    srcPath := filepath.Join(src, path)
+    dstPath := filepath.Join(dst, path)
+
+    si, err := os.Lstat(srcPath)
+    if os.IsNotExist(err) || (err == nil && skipped(si)) {
+      if err = os.RemoveAll(dstPath); err != nil {
+        return err
+      }
+      continue
+    } else if err != nil {
+      return err
+    }
+
+    if err = makeParents(src, dst, path); err != nil {
+      return err
+    }
+    if si.IsDir() {
+      if err = linkSyncDir(ctx, srcPath, dstPath, "", t); err != nil {
+        return err
+      }
+      continue
+    }
+
+    t.file(srcPath)
+    if di, err := os.Lstat(dstPath); err == nil && !fileChanged(si, di) {
+      t.done(si.Size(), false)
+      continue
+    } else if err == nil && di.IsDir() {
+      if err = os.RemoveAll(dstPath); err != nil {
+        return err
+      }
+    }
+    if err = copyFileWithTimes(ctx, srcPath, dstPath, si); err != nil {
+      return err
+    }
+    t.done(si.Size(), true)
+  }
+  return nil
+}
+
+func hasParentIn(path string, dirs map[string]bool) bool {
+  for parent := filepath.Dir(path); parent != "."; parent = filepath.Dir(parent) {
+    if dirs[parent] {
+      return true
+    }
+  }
+  return false
+}
+
+/* makeParents() creates the directories leading to path in dst
+with the modes they have in src */
+func makeParents(src string, dst string, path string) error {
+  parent := filepath.Dir(path)
+  if parent == "." {
+    return nil
+  }
+  if di, err := os.Stat(filepath.Join(dst, parent)); err == nil && di.IsDir() {
+    return nil
+  }
+  if err := makeParents(src, dst, parent); err != nil {
+    return err
+  }
+
+  si, err := os.Stat(filepath.Join(src, parent))
+  if err != nil {
+    return err
+  }
+  dstParent := filepath.Join(dst, parent)
+  if di, err := os.Lstat(dstParent); err == nil && !di.IsDir() {
+    if err = os.Remove(dstParent); err != nil {
+      return err
+    }
+  }
+  return os.Mkdir(dstParent, si.Mode())
+}
+
+/* skipped() reports whether fi is left out of backups. Only regular
+files and directories are backed up. Symlinks could point anywhere and
+fifos, sockets and devices can't be copied like files */
+func skipped(fi os.FileInfo) bool {
+  return !fi.IsDir() && !fi.Mode().IsRegular()
+}
+
+func fileChanged(original os.FileInfo, reflected os.FileInfo) bool {
+  if !reflected.Mode().IsRegular() {
+    return true
+  }
+  return original.Size() != reflected.Size() ||
+    !original.ModTime().Equal(reflected.ModTime())
+}
+
+/* copyFileWithTimes() atomically replaces dst with src and stamps
+dst with the modification time of src so later size/mtime
+comparisons see the two as identical */
+func copyFileWithTimes(ctx context.Context, src string, dst string, si os.FileInfo) error {
+  if err := copyFile(ctx, src, dst); err != nil {
+    return err
+  }
+  return os.Chtimes(dst, si.ModTime(), si.ModTime())
+}
@@ -0,0 +1,111 @@
+package reflector
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "context"
+  "path/filepath"
+  "time"
+  "os"
+)
+
+// Progress is sent at most this often apart from phase changes
+var ProgressInterval time.Duration = 250 * time.Millisecond
+
+/* tracker counts what a backup copied for Stats() and sends how far
+the backup has come to whoever asked for it with ReportProgress().
+A nil tracker counts nothing */
+type tracker struct {
+  stats processor.BackupStats
+  progress processor.BackupProgress
+  updates chan<- processor.BackupProgress
+  lastSent time.Time
+}
+
+func newTracker(updates chan<- processor.BackupProgress) *tracker {
+  return &tracker{updates: updates}
+}
+
+/* scan() counts the files and bytes under each of roots so progress
+can be measured against them. Unreadable entries are left for the
+backup itself to fail on so only a canceled ctx is returned */
+func (t *tracker) scan(ctx context.Context, roots ...string) error {
+  t.progress.Phase = processor.ScanningPhase
+  t.send(true)
+
+  for _, root := range roots {
+    err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+      if ctxErr := ctx.Err(); ctxErr != nil {
+        return ctxErr
+      }
+      if err != nil || !fi.Mode().IsRegular() {
+        return nil
+      }
+      t.progress.FilesScanned++
+      t.progress.BytesTotal += fi.Size()
+      t.send(false)
+      return nil
+    })
+    if err != nil {
+      return err
+    }
+  }
+
+  t.progress.Phase = processor.CopyingPhase
+  t.send(true)
+  return nil
+}
+
+// file() marks path as the file being worked on
+func (t *tracker) file(path string) {
+  if t == nil {
+    return
+  }
+  t.progress.CurrentFile = path
+  t.send(false)
+}
+
+/* done() marks a file of size bytes as dealt with. Only copied
+files count towards the stats */
+func (t *tracker) done(size int64, copied bool) {
+  if t == nil {
+    return
+  }
+  t.progress.BytesDone += size
+  if copied {
+    t.progress.FilesCopied++
+    t.stats.FilesCopied++
+    t.stats.BytesCopied += size
+  }
+  t.send(false)
+}
+
+// counted() is what the backup copied so far
+func (t *tracker) counted() processor.BackupStats {
+  if t == nil {
+    return processor.BackupStats{}
+  }
+  return t.stats
+}
+
+// finish() sends the final progress of a completed backup
+func (t *tracker) finish() {
+  t.progress.CurrentFile = ""
+  t.send(true)
+}
+
+/* send() passes on the progress unless the last update went out
+less than ProgressInterval ago. It never waits on a slow reader */
+func (t *tracker) send(force bool) {
+  if t.updates == nil {
+    return
+  }
+  now := time.Now()
+  if !force && now.Sub(t.lastSent) < ProgressInterval {
+    return
+  }
+  select {
+    case t.updates<-t.progress:
+      t.lastSent = now
+    default:
+  }
+}
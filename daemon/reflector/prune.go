@@ -0,0 +1,156 @@
+package reflector
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "path/filepath"
+  "syscall"
+  "strconv"
+  "time"
+  "fmt"
+  "os"
+)
+
+type inodeKey struct {
+  dev uint64
+  ino uint64
+}
+
+/* SnapshotReflector.Prune() removes every snapshot that the policy
+doesn't retain. Snapshots share hard linked files so removing one
+only frees the files no other snapshot links to, which is also how
+their size is counted against MaxSize */
+func (s SnapshotReflector) Prune(policy processor.RetentionPolicy, dryRun bool) ([]string, error) {
+  snapshots, err := ListSnapshots(s.reflectingDirectory)
+  if err != nil {
+    return nil, fmt.Errorf("Couldn't list snapshots in SnapshotReflector.Prune(): %v", err)
+  }
+  if len(snapshots) == 0 || policy.IsZero() {
+    return []string{}, nil
+  }
+
+  keep := retainedSnapshots(snapshots, policy)
+  latest, err := FindLatestSnapshot(s.reflectingDirectory)
+  if err == nil {
+    keep[latest.Name] = true
+  }
+
+  if policy.MaxSize > 0 {
+    sizes, err := snapshotInodes(s.reflectingDirectory, snapshots)
+    if err != nil {
+      return nil, fmt.Errorf("Couldn't size snapshots in SnapshotReflector.Prune(): %v", err)
+    }
+    trimToSize(snapshots, keep, sizes, policy.MaxSize, latest.Name)
+  }
+
+  pruned := make([]string, 0)
+  for _, snapshot := range snapshots {
+    if keep[snapshot.Name] {
+      continue
+    }
+    path := filepath.Join(s.reflectingDirectory, snapshot.Name)
+    if !dryRun {
+      if err = os.RemoveAll(path); err != nil {
+        return pruned, fmt.Errorf("Couldn't remove %s in SnapshotReflector.Prune(): %v", path, err)
+      }
+    }
+    pruned = append(pruned, path)
+  }
+  return pruned, nil
+}
+
+/* retainedSnapshots() applies the count based rules of the policy.
+Snapshots must be sorted oldest to newest */
+func retainedSnapshots(snapshots []Snapshot, policy processor.RetentionPolicy) map[string]bool {
+  keep := make(map[string]bool)
+  if policy.KeepLast == 0 && policy.Hourly == 0 && policy.Daily == 0 &&
+    policy.Weekly == 0 && policy.Monthly == 0 {
+    for _, snapshot := range snapshots {
+      keep[snapshot.Name] = true
+    }
+    return keep
+  }
+
+  for i := len(snapshots) - 1; i >= 0 && len(snapshots) - i <= policy.KeepLast; i-- {
+    keep[snapshots[i].Name] = true
+  }
+
+  buckets := []struct{
+    count int
+    period func(time.Time) string
+  }{
+    {policy.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+    {policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+    {policy.Weekly, func(t time.Time) string {
+      year, week := t.ISOWeek()
+      return strconv.Itoa(year)+"-"+strconv.Itoa(week)
+    }},
+    {policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+  }
+
+  for _, bucket := range buckets {
+    seen := make(map[string]bool)
+    for i := len(snapshots) - 1; i >= 0 && len(seen) < bucket.count; i-- {
+      period := bucket.period(snapshots[i].Time)
+      if !seen[period] {
+        seen[period] = true
+        keep[snapshots[i].Name] = true
+      }
+    }
+  }
+  return keep
+}
+
+/* trimToSize() drops the oldest kept snapshots until the files
+referenced by the remaining ones fit in maxSize */
+func trimToSize(snapshots []Snapshot, keep map[string]bool, inodes map[string]map[inodeKey]int64, maxSize int64, latest string) {
+  for _, snapshot := range snapshots {
+    if retainedSize(keep, inodes) <= maxSize {
+      return
+    }
+    if snapshot.Name != latest && snapshot.Name != snapshots[len(snapshots) - 1].Name {
+      delete(keep, snapshot.Name)
+    }
+  }
+}
+
+func retainedSize(keep map[string]bool, inodes map[string]map[inodeKey]int64) int64 {
+  counted := make(map[inodeKey]bool)
+  var total int64
+  for name, _ := range keep {
+    for key, size := range inodes[name] {
+      if !counted[key] {
+        counted[key] = true
+        total += size
+      }
+    }
+  }
+  return total
+}
+
+// snapshotInodes() maps each snapshot to the inodes and sizes of its files
+func snapshotInodes(root string, snapshots []Snapshot) (map[string]map[inodeKey]int64, error) {
+  inodes := make(map[string]map[inodeKey]int64)
+  for _, snapshot := range snapshots {
+    files := make(map[inodeKey]int64)
+    err := filepath.Walk(filepath.Join(root, snapshot.Name), func(path string, fi os.FileInfo, err error) error {
+      if err != nil {
+        return err
+      }
+      if !fi.Mode().IsRegular() {
+        return nil
+      }
+      // Without inode numbers every file is counted separately
+      key := inodeKey{dev: uint64(len(inodes)), ino: uint64(len(files))}
+      if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+        key = inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+      }
+      files[key] = fi.Size()
+      return nil
+    })
+    if err != nil {
+      return nil, err
+    }
+    inodes[snapshot.Name] = files
+  }
+  return inodes, nil
+}
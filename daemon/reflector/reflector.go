@@ -2,13 +2,15 @@ package reflector
 
 import (
   "github.com/arstevens/goback/daemon/processor"
+  "context"
   "fmt"
-  "os"
 )
 
 type PlainReflector struct {
   originalDirectory string
   reflectingDirectory string
+  track *tracker
+  updates chan<- processor.BackupProgress
 }
 
 // Satisfies interactor.reflectorCreator
@@ -20,18 +22,38 @@ func NewPlainReflector(original, reflecting string) (processor.Reflector, error)
   return &pr, nil
 }
 
-/* PlainReflector.Backup() finds the differences between the
-reflecting map and the original map and performs the necessary
-operations to turn the reflecting directory into the original directory */
-func (p PlainReflector) Backup() error {
-  err := os.RemoveAll(p.reflectingDirectory)
+/* PlainReflector.Backup() copies the original directory into a
+staging directory next to the reflection and swaps it into place
+once the copy is complete. A staging directory left by an interrupted
+backup is resumed rather than copied again from scratch */
+func (p *PlainReflector) Backup(ctx context.Context) error {
+  p.track = newTracker(p.updates)
+  err := recoverStaging(p.reflectingDirectory)
   if err != nil {
-    return fmt.Errorf("Couldn't delete old contents of directory in Backup(): %v", err)
+    return fmt.Errorf("Couldn't recover previous backup in Backup(): %v", err)
+  }
+  if err = p.track.scan(ctx, p.originalDirectory); err != nil {
+    return fmt.Errorf("Couldn't scan original in Backup(): %w", err)
+  }
+
+  staging := stagingPath(p.reflectingDirectory)
+  err = syncDir(ctx, p.originalDirectory, staging, p.track)
+  if err != nil {
+    return fmt.Errorf("Couldn't copy directory over in Backup(): %w", err)
   }
 
-  err = copyDir(p.originalDirectory, p.reflectingDirectory)
+  err = swapStaging(staging, p.reflectingDirectory)
   if err != nil {
-    return fmt.Errorf("Couldn't copy directory over in Backup(): %v", err)
+    return fmt.Errorf("Couldn't swap in new contents of directory in Backup(): %v", err)
   }
+  p.track.finish()
   return nil
 }
+
+func (p PlainReflector) Stats() processor.BackupStats {
+  return p.track.counted()
+}
+
+func (p *PlainReflector) ReportProgress(c chan<- processor.BackupProgress) {
+  p.updates = c
+}
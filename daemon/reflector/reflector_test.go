@@ -1,6 +1,16 @@
 package reflector
 import (
+  "github.com/arstevens/goback/daemon/processor"
+  "context"
+  "errors"
+  "path/filepath"
+  "io/ioutil"
+  "strings"
+  "syscall"
+  "fmt"
   "testing"
+  "time"
+  "os"
 )
 
 func TestReflector(t *testing.T) {
@@ -11,8 +21,675 @@ func TestReflector(t *testing.T) {
     panic(err)
   }
 
-  err = ref.Backup()
+  err = ref.Backup(context.Background())
   if err != nil {
     panic(err)
   }
 }
+
+func TestPlainReflectorStaging(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  refRoot := filepath.Join(tmp, "ref")
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "new")
+
+  // Simulate a crash after the old reflection was retired
+  writeTestFile(t, filepath.Join(retiredPath(refRoot), "a.txt"), "old")
+  writeTestFile(t, filepath.Join(stagingPath(refRoot), "partial.txt"), "partial")
+
+  ref, err := NewPlainReflector(origRoot, refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  expectTestFile(t, filepath.Join(refRoot, "a.txt"), "new")
+  for _, leftover := range []string{filepath.Join(refRoot, "partial.txt"), stagingPath(refRoot), retiredPath(refRoot)} {
+    if _, err = os.Stat(leftover); !os.IsNotExist(err) {
+      t.Errorf("Expected %s to be cleaned up", leftover)
+    }
+  }
+}
+
+func TestIncrementalReflector(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  refRoot := filepath.Join(tmp, "ref")
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "a")
+  writeTestFile(t, filepath.Join(origRoot, "sub", "b.txt"), "b")
+  writeTestFile(t, filepath.Join(origRoot, "gone", "c.txt"), "c")
+
+  ref, err := NewIncrementalReflector(origRoot, refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "changed")
+  os.RemoveAll(filepath.Join(origRoot, "gone"))
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  expectTestFile(t, filepath.Join(refRoot, "a.txt"), "changed")
+  expectTestFile(t, filepath.Join(refRoot, "sub", "b.txt"), "b")
+  if _, err = os.Stat(filepath.Join(refRoot, "gone")); !os.IsNotExist(err) {
+    t.Errorf("Expected removed directory to be deleted from reflection")
+  }
+}
+
+func TestIncrementalReflectorChanges(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  refRoot := filepath.Join(tmp, "ref")
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "a")
+  writeTestFile(t, filepath.Join(origRoot, "gone", "c.txt"), "c")
+
+  ref, err := NewIncrementalReflector(origRoot, refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "changed")
+  writeTestFile(t, filepath.Join(origRoot, "new", "deep", "d.txt"), "d")
+  writeTestFile(t, filepath.Join(origRoot, "unlisted.txt"), "u")
+  os.RemoveAll(filepath.Join(origRoot, "gone"))
+  ref.(processor.ChangeSetter).SetChanges(processor.ChangeSet{Paths: map[string][]processor.ChangeOp{
+    "a.txt": []processor.ChangeOp{processor.WriteOp},
+    "new": []processor.ChangeOp{processor.CreateOp},
+    "new/deep/d.txt": []processor.ChangeOp{processor.CreateOp},
+    "gone": []processor.ChangeOp{processor.RemoveOp},
+  }})
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  expectTestFile(t, filepath.Join(refRoot, "a.txt"), "changed")
+  expectTestFile(t, filepath.Join(refRoot, "new", "deep", "d.txt"), "d")
+  if _, err = os.Stat(filepath.Join(refRoot, "gone")); !os.IsNotExist(err) {
+    t.Errorf("Expected removed directory to be deleted from reflection")
+  }
+  // Only the changed paths are looked at
+  if _, err = os.Stat(filepath.Join(refRoot, "unlisted.txt")); !os.IsNotExist(err) {
+    t.Errorf("Expected a file missing from the changes to be left alone")
+  }
+  if stats := ref.(processor.StatsReporter).Stats(); stats.FilesCopied != 2 {
+    t.Errorf("Expected 2 files copied but got %d", stats.FilesCopied)
+  }
+
+  // Without changes the next backup catches up on everything
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  expectTestFile(t, filepath.Join(refRoot, "unlisted.txt"), "u")
+}
+
+func TestSHA1Reflector(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  refRoot := filepath.Join(tmp, "ref")
+  origFile := filepath.Join(origRoot, "sub", "a.txt")
+  writeTestFile(t, origFile, "aaaa")
+  writeTestFile(t, filepath.Join(origRoot, "b.txt"), "b")
+
+  ref, err := NewSHA1Reflector(origRoot, refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  // Same size and mtime but different contents must still be copied
+  fi, err := os.Stat(origFile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  writeTestFile(t, origFile, "bbbb")
+  os.Chtimes(origFile, fi.ModTime(), fi.ModTime())
+  os.Remove(filepath.Join(origRoot, "b.txt"))
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  expectTestFile(t, filepath.Join(refRoot, "sub", "a.txt"), "bbbb")
+  if _, err = os.Stat(filepath.Join(refRoot, "b.txt")); !os.IsNotExist(err) {
+    t.Errorf("Expected removed file to be deleted from reflection")
+  }
+  if _, err = LoadSHA1ChangeMap(filepath.Join(refRoot, ChangeMapFile)); err != nil {
+    t.Errorf("Expected change map to be saved: %v", err)
+  }
+
+  // Moved and swapped files are taken from the reflection
+  writeTestFile(t, filepath.Join(origRoot, "x.txt"), "xx")
+  writeTestFile(t, filepath.Join(origRoot, "y.txt"), "yy")
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if err = os.Rename(origFile, filepath.Join(origRoot, "moved.txt")); err != nil {
+    t.Fatal(err)
+  }
+  writeTestFile(t, filepath.Join(origRoot, "x.txt"), "yy")
+  writeTestFile(t, filepath.Join(origRoot, "y.txt"), "xx")
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  expectTestFile(t, filepath.Join(refRoot, "moved.txt"), "bbbb")
+  expectTestFile(t, filepath.Join(refRoot, "x.txt"), "yy")
+  expectTestFile(t, filepath.Join(refRoot, "y.txt"), "xx")
+  if _, err = os.Stat(filepath.Join(refRoot, "sub", "a.txt")); !os.IsNotExist(err) {
+    t.Errorf("Expected the old path of a moved file to be deleted from reflection")
+  }
+  if stats := ref.(processor.StatsReporter).Stats(); stats.FilesCopied != 2 {
+    t.Errorf("Expected only the swapped files to be copied but got %+v", stats)
+  }
+}
+
+/* A backup that stops after changing part of the reflection must not
+leave a manifest behind that claims the old contents are still there */
+func TestSHA1InterruptedBackup(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  refRoot := filepath.Join(tmp, "ref")
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "old")
+  ref, err := NewSHA1Reflector(origRoot, refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+
+  // The second backup fails on a file that vanished after a.txt was copied
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "new")
+  failing := &ChangeMapReflector{
+    originalDirectory: origRoot,
+    reflectingDirectory: refRoot,
+    createMap: func(ctx context.Context, root string) (processor.ChangeMap, error) {
+      cm, err := NewSHA1ChangeMap(ctx, root)
+      if err == nil && root == origRoot {
+        cm.(*SHA1ChangeMap).Hashes["vanished.txt"] = "0000"
+      }
+      return cm, err
+    },
+    loadMap: LoadSHA1ChangeMap,
+  }
+  if err = failing.Backup(context.Background()); err == nil {
+    t.Fatalf("Expected the backup of a vanished file to fail")
+  }
+  expectTestFile(t, filepath.Join(refRoot, "a.txt"), "new")
+  if _, err = os.Stat(filepath.Join(refRoot, ChangeMapFile)); !os.IsNotExist(err) {
+    t.Errorf("Expected the failed backup to leave no change map")
+  }
+
+  // Going back to the old contents must not be mistaken for no change
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "old")
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  expectTestFile(t, filepath.Join(refRoot, "a.txt"), "old")
+  if stats := ref.(processor.StatsReporter).Stats(); stats.FilesCopied != 1 {
+    t.Errorf("Expected only the changed file to be copied but got %+v", stats)
+  }
+}
+
+func TestSnapshotReflector(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  refRoot := filepath.Join(tmp, "ref")
+  writeTestFile(t, filepath.Join(origRoot, "same.txt"), "same")
+  writeTestFile(t, filepath.Join(origRoot, "sub", "edit.txt"), "before")
+
+  ref, err := NewSnapshotReflector(origRoot, refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  first, err := FindLatestSnapshot(refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  writeTestFile(t, filepath.Join(origRoot, "sub", "edit.txt"), "after!")
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  second, err := FindLatestSnapshot(refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if second.Name == first.Name {
+    t.Fatalf("Expected a new snapshot to be created")
+  }
+
+  expectTestFile(t, filepath.Join(refRoot, first.Name, "sub", "edit.txt"), "before")
+  expectTestFile(t, filepath.Join(refRoot, LatestSnapshot, "sub", "edit.txt"), "after!")
+
+  oldSame, _ := os.Stat(filepath.Join(refRoot, first.Name, "same.txt"))
+  newSame, _ := os.Stat(filepath.Join(refRoot, second.Name, "same.txt"))
+  if !os.SameFile(oldSame, newSame) {
+    t.Errorf("Expected unchanged file to be hard linked between snapshots")
+  }
+
+  snapshots, err := ListSnapshots(refRoot)
+  if err != nil || len(snapshots) != 2 {
+    t.Errorf("Expected 2 snapshots but found %v (%v)", snapshots, err)
+  }
+
+  // Backups within the same second still get their own snapshot
+  writeTestFile(t, filepath.Join(origRoot, "sub", "edit.txt"), "again")
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  snapshots, err = ListSnapshots(refRoot)
+  if err != nil || len(snapshots) != 4 {
+    t.Fatalf("Expected 4 snapshots but found %v (%v)", snapshots, err)
+  }
+  if latest, _ := FindLatestSnapshot(refRoot); latest.Name != snapshots[3].Name {
+    t.Errorf("Expected %s to be the latest snapshot but got %s", snapshots[3].Name, latest.Name)
+  }
+  expectTestFile(t, filepath.Join(refRoot, snapshots[1].Name, "sub", "edit.txt"), "after!")
+  expectTestFile(t, filepath.Join(refRoot, LatestSnapshot, "sub", "edit.txt"), "again")
+}
+
+func TestSnapshotPrune(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  // One snapshot every 6 hours for 3 days
+  start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)
+  var names []string
+  for i := 0; i < 12; i++ {
+    name := start.Add(time.Duration(i) * 6 * time.Hour).Format(SnapshotTimeFormat)
+    writeTestFile(t, filepath.Join(tmp, name, "shared.txt"), "shared")
+    names = append(names, name)
+  }
+  setLatestSnapshot(tmp, names[len(names) - 1])
+
+  ref, err := NewSnapshotReflector("", tmp)
+  if err != nil {
+    t.Fatal(err)
+  }
+  policy := processor.RetentionPolicy{KeepLast: 2, Daily: 3}
+  pruned, err := ref.(processor.Pruner).Prune(policy, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Newest two plus the last snapshot of the two earlier days
+  if len(pruned) != 8 {
+    t.Errorf("Expected 8 snapshots to be pruned but got %d: %v", len(pruned), pruned)
+  }
+  if snapshots, _ := ListSnapshots(tmp); len(snapshots) != 12 {
+    t.Errorf("Expected dry run to leave all snapshots but found %d", len(snapshots))
+  }
+
+  pruned, err = ref.(processor.Pruner).Prune(processor.RetentionPolicy{MaxSize: 1}, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  snapshots, _ := ListSnapshots(tmp)
+  if len(snapshots) != 1 || snapshots[0].Name != names[len(names) - 1] {
+    t.Errorf("Expected only the latest snapshot to survive but found %v", snapshots)
+  }
+}
+
+func TestRestore(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  refRoot := filepath.Join(tmp, "ref")
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "backed up")
+  writeTestFile(t, filepath.Join(origRoot, "sub", "b.txt"), "b")
+
+  ref, err := NewSnapshotReflector(origRoot, refRoot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = ref.Backup(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "clobbered")
+  os.RemoveAll(filepath.Join(origRoot, "sub"))
+
+  restorer := ref.(processor.Restorer)
+  opts := processor.RestoreOptions{Target: origRoot, Policy: processor.KeepBothConflicts, DryRun: true}
+  actions, err := restorer.Restore(context.Background(), opts)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(actions) != 2 {
+    t.Errorf("Expected 2 restore actions but got %v", actions)
+  }
+  if _, err = os.Stat(filepath.Join(origRoot, "sub")); !os.IsNotExist(err) {
+    t.Errorf("Expected dry run to leave the original untouched")
+  }
+
+  opts.DryRun = false
+  if _, err = restorer.Restore(context.Background(), opts); err != nil {
+    t.Fatal(err)
+  }
+  expectTestFile(t, filepath.Join(origRoot, "a.txt"), "clobbered")
+  expectTestFile(t, filepath.Join(origRoot, "a (restored).txt"), "backed up")
+  expectTestFile(t, filepath.Join(origRoot, "sub", "b.txt"), "b")
+
+  opts.Policy = processor.OverwriteConflicts
+  if _, err = restorer.Restore(context.Background(), opts); err != nil {
+    t.Fatal(err)
+  }
+  expectTestFile(t, filepath.Join(origRoot, "a.txt"), "backed up")
+
+  // Files that match the backup are never copied again
+  opts.Policy = processor.KeepBothConflicts
+  if actions, err = restorer.Restore(context.Background(), opts); err != nil {
+    t.Fatal(err)
+  }
+  for _, action := range actions {
+    if !strings.HasPrefix(action, "unchanged ") {
+      t.Errorf("Expected identical files to be left alone but got %s", action)
+    }
+  }
+  for _, name := range []string{"a (restored 2).txt", filepath.Join("sub", "b (restored).txt")} {
+    if _, err = os.Lstat(filepath.Join(origRoot, name)); !os.IsNotExist(err) {
+      t.Errorf("Expected no copy of an identical file but found %s", name)
+    }
+  }
+  opts.Policy = processor.OverwriteConflicts
+
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "clobbered again")
+  writeTestFile(t, filepath.Join(origRoot, "sub", "b.txt"), "left alone")
+  opts.Path = "a.txt"
+  actions, err = restorer.Restore(context.Background(), opts)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(actions) != 1 {
+    t.Errorf("Expected only the one file to be restored but got %v", actions)
+  }
+  expectTestFile(t, filepath.Join(origRoot, "a.txt"), "backed up")
+  expectTestFile(t, filepath.Join(origRoot, "sub", "b.txt"), "left alone")
+
+  opts.At = time.Now().Add(-time.Hour)
+  if _, err = restorer.Restore(context.Background(), opts); err == nil {
+    t.Errorf("Expected restoring from before the first snapshot to fail")
+  }
+}
+
+func TestCanceledBackup(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "a")
+  creators := map[string]func(string, string) (processor.Reflector, error){
+    "pref": NewPlainReflector,
+    "iref": NewIncrementalReflector,
+    "sref": NewSHA1Reflector,
+    "snap": NewSnapshotReflector,
+  }
+
+  for code, create := range creators {
+    refRoot := filepath.Join(tmp, code)
+    ref, err := create(origRoot, refRoot)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if err = ref.Backup(ctx); !errors.Is(err, context.Canceled) {
+      t.Errorf("Expected %s to stop with context.Canceled but got %v", code, err)
+    }
+
+    // The next backup finishes what the canceled one left behind
+    if err = ref.Backup(context.Background()); err != nil {
+      t.Fatalf("Backup after cancel failed for %s: %v", code, err)
+    }
+    if code == "snap" {
+      latest, err := FindLatestSnapshot(refRoot)
+      if err != nil {
+        t.Fatal(err)
+      }
+      refRoot = filepath.Join(refRoot, latest.Name)
+    }
+    expectTestFile(t, filepath.Join(refRoot, "a.txt"), "a")
+  }
+}
+
+func TestBackupProgress(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "aaaa")
+  writeTestFile(t, filepath.Join(origRoot, "sub", "b.txt"), "bb")
+  creators := map[string]func(string, string) (processor.Reflector, error){
+    "pref": NewPlainReflector,
+    "iref": NewIncrementalReflector,
+    "sref": NewSHA1Reflector,
+    "snap": NewSnapshotReflector,
+  }
+
+  for code, create := range creators {
+    ref, err := create(origRoot, filepath.Join(tmp, code))
+    if err != nil {
+      t.Fatal(err)
+    }
+    updates := make(chan processor.BackupProgress, 100)
+    ref.(processor.ProgressReporter).ReportProgress(updates)
+
+    if err = ref.Backup(context.Background()); err != nil {
+      t.Fatalf("Backup failed for %s: %v", code, err)
+    }
+    close(updates)
+
+    var last processor.BackupProgress
+    for update := range updates {
+      last = update
+    }
+    expected := processor.BackupProgress{
+      Phase: processor.CopyingPhase,
+      FilesScanned: 2,
+      FilesCopied: 2,
+      BytesDone: 6,
+      BytesTotal: 6,
+    }
+    if last != expected {
+      t.Errorf("Expected %s to end with %+v but got %+v", code, expected, last)
+    }
+  }
+}
+
+func TestCopyFileSymlinks(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  secret := filepath.Join(tmp, "secret")
+  writeTestFile(t, secret, "secret")
+  src := filepath.Join(tmp, "src")
+  writeTestFile(t, src, "src")
+
+  // Sources swapped for symlinks aren't followed
+  linked := filepath.Join(tmp, "linked")
+  if err = os.Symlink(secret, linked); err != nil {
+    t.Fatal(err)
+  }
+  if err = copyFile(context.Background(), linked, filepath.Join(tmp, "copy")); err == nil {
+    t.Errorf("Expected copying a symlink to fail")
+  }
+
+  // Neither are symlinks planted at the destination
+  dst := filepath.Join(tmp, "dst")
+  if err = os.Symlink(secret, dst); err != nil {
+    t.Fatal(err)
+  }
+  if err = copyFile(context.Background(), src, dst); err != nil {
+    t.Fatal(err)
+  }
+  expectTestFile(t, secret, "secret")
+  if fi, err := os.Lstat(dst); err != nil || !fi.Mode().IsRegular() {
+    t.Errorf("Expected the symlink to be replaced by a regular file")
+  }
+  expectTestFile(t, dst, "src")
+}
+
+// A canceled copy stops without touching the destination
+func TestCopyFileCancel(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  src := filepath.Join(tmp, "src")
+  writeTestFile(t, src, "new")
+  dst := filepath.Join(tmp, "dst")
+  writeTestFile(t, dst, "old")
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  if err = copyFile(ctx, src, dst); !errors.Is(err, context.Canceled) {
+    t.Fatalf("Expected the copy to be canceled but got %v", err)
+  }
+  expectTestFile(t, dst, "old")
+  if entries, err := ioutil.ReadDir(tmp); err != nil || len(entries) != 2 {
+    t.Errorf("Expected the temporary file to be removed")
+  }
+}
+
+// Fifos are left out instead of blocking or failing a backup
+func TestSpecialFiles(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  origRoot := filepath.Join(tmp, "orig")
+  writeTestFile(t, filepath.Join(origRoot, "a.txt"), "a")
+  if err = syscall.Mkfifo(filepath.Join(origRoot, "fifo"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  creators := map[string]func(string, string) (processor.Reflector, error){
+    "pref": NewPlainReflector,
+    "iref": NewIncrementalReflector,
+    "sref": NewSHA1Reflector,
+    "snap": NewSnapshotReflector,
+  }
+
+  for code, create := range creators {
+    refRoot := filepath.Join(tmp, code)
+    ref, err := create(origRoot, refRoot)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if err = backupWithin(ref, 5 * time.Second); err != nil {
+      t.Fatalf("Backup with a fifo failed for %s: %v", code, err)
+    }
+    if setter, ok := ref.(processor.ChangeSetter); ok {
+      fifo := processor.Change{Root: origRoot, Path: filepath.Join(origRoot, "fifo"), Op: processor.CreateOp}
+      setter.SetChanges(processor.NewChangeSet(origRoot, []processor.Change{fifo}))
+      if err = backupWithin(ref, 5 * time.Second); err != nil {
+        t.Fatalf("Backup of a changed fifo failed for %s: %v", code, err)
+      }
+    }
+
+    if code == "snap" {
+      refRoot = filepath.Join(refRoot, LatestSnapshot)
+    }
+    expectTestFile(t, filepath.Join(refRoot, "a.txt"), "a")
+    if _, err = os.Lstat(filepath.Join(refRoot, "fifo")); !os.IsNotExist(err) {
+      t.Errorf("Expected %s to leave the fifo out", code)
+    }
+  }
+}
+
+func backupWithin(ref processor.Reflector, limit time.Duration) error {
+  done := make(chan error, 1)
+  go func() {
+    done<-ref.Backup(context.Background())
+  }()
+  select {
+    case err := <-done:
+      return err
+    case <-time.After(limit):
+      return fmt.Errorf("Backup still running after %s", limit)
+  }
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    t.Fatal(err)
+  }
+  if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func expectTestFile(t *testing.T, path string, content string) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatalf("Couldn't read %s: %v", path, err)
+  }
+  if string(data) != content {
+    t.Errorf("Expected %s to contain %q but found %q", path, content, string(data))
+  }
+}
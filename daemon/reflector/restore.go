@@ -0,0 +1,195 @@
+package reflector
+
+import (
+  "context"
+  "github.com/arstevens/goback/daemon/processor"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+  "fmt"
+  "os"
+)
+
+func (p PlainReflector) Restore(ctx context.Context, opts processor.RestoreOptions) ([]string, error) {
+  return restoreMirror(ctx, p.reflectingDirectory, opts)
+}
+
+func (i IncrementalReflector) Restore(ctx context.Context, opts processor.RestoreOptions) ([]string, error) {
+  return restoreMirror(ctx, i.reflectingDirectory, opts)
+}
+
+func (c ChangeMapReflector) Restore(ctx context.Context, opts processor.RestoreOptions) ([]string, error) {
+  return restoreMirror(ctx, c.reflectingDirectory, opts)
+}
+
+/* SnapshotReflector.Restore() restores the snapshot named in the
+options, the newest one taken no later than opts.At or otherwise
+the latest one */
+func (s SnapshotReflector) Restore(ctx context.Context, opts processor.RestoreOptions) ([]string, error) {
+  name := opts.Snapshot
+  if name == "" && !opts.At.IsZero() {
+    snapshots, err := ListSnapshots(s.reflectingDirectory)
+    if err != nil {
+      return nil, fmt.Errorf("Couldn't list snapshots in SnapshotReflector.Restore(): %v", err)
+    }
+    for _, snapshot := range snapshots {
+      if !snapshot.Time.After(opts.At) {
+        name = snapshot.Name
+      }
+    }
+    if name == "" {
+      return nil, fmt.Errorf("No snapshot taken before %s in SnapshotReflector.Restore()", opts.At.Format(time.RFC3339))
+    }
+  } else if name == "" {
+    latest, err := FindLatestSnapshot(s.reflectingDirectory)
+    if err != nil {
+      return nil, fmt.Errorf("Couldn't find a snapshot to restore in SnapshotReflector.Restore(): %v", err)
+    }
+    name = latest.Name
+  }
+
+  snapshot := filepath.Join(s.reflectingDirectory, filepath.Base(name))
+  if fi, err := os.Stat(snapshot); err != nil || !fi.IsDir() {
+    return nil, fmt.Errorf("No snapshot named %s in SnapshotReflector.Restore()", name)
+  }
+  return restoreTree(ctx, snapshot, opts)
+}
+
+func restoreMirror(ctx context.Context, reflecting string, opts processor.RestoreOptions) ([]string, error) {
+  if opts.Snapshot != "" || !opts.At.IsZero() {
+    return nil, fmt.Errorf("Reflection %s does not keep snapshots", reflecting)
+  }
+  return restoreTree(ctx, reflecting, opts)
+}
+
+/* restoreTree() copies opts.Path (or everything) under root into
+the same place under opts.Target. Files that already exist in the
+target are overwritten, skipped or restored next to the existing
+file depending on opts.Policy */
+func restoreTree(ctx context.Context, root string, opts processor.RestoreOptions) ([]string, error) {
+  switch opts.Policy {
+    case processor.OverwriteConflicts, processor.SkipConflicts, processor.KeepBothConflicts:
+    default:
+      return nil, fmt.Errorf("Unknown conflict policy %s in restoreTree()", opts.Policy)
+  }
+
+  subpath := filepath.Clean(opts.Path)
+  if filepath.IsAbs(subpath) || subpath == ".." || strings.HasPrefix(subpath, ".."+string(filepath.Separator)) {
+    return nil, fmt.Errorf("Restore path %s is outside the backup in restoreTree()", opts.Path)
+  }
+  src := filepath.Join(root, subpath)
+  target := filepath.Join(opts.Target, subpath)
+
+  si, err := os.Lstat(src)
+  if err != nil {
+    return nil, fmt.Errorf("Nothing backed up at %s in restoreTree(): %v", opts.Path, err)
+  }
+  if si.Mode().IsRegular() {
+    if !opts.DryRun {
+      if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+        return nil, fmt.Errorf("Couldn't create %s in restoreTree(): %v", filepath.Dir(target), err)
+      }
+    }
+    action, err := restoreFile(ctx, src, target, si, opts)
+    if err != nil {
+      return nil, fmt.Errorf("Couldn't restore %s in restoreTree(): %w", src, err)
+    }
+    return []string{action}, nil
+  }
+
+  actions := make([]string, 0)
+  err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    if err = ctx.Err(); err != nil {
+      return err
+    }
+    rel, err := filepath.Rel(src, path)
+    if err != nil {
+      return err
+    }
+    if rel == ChangeMapFile || strings.HasSuffix(rel, tempSuffix) || fi.Mode()&os.ModeSymlink != 0 {
+      return nil
+    }
+    dst := filepath.Join(target, rel)
+
+    if fi.IsDir() {
+      di, err := os.Lstat(dst)
+      if err == nil && di.IsDir() {
+        return nil
+      } else if err == nil && opts.Policy != processor.OverwriteConflicts {
+        actions = append(actions, "skip "+dst)
+        return filepath.SkipDir
+      }
+      if opts.DryRun {
+        return nil
+      }
+      if err == nil {
+        if err = os.Remove(dst); err != nil {
+          return err
+        }
+      }
+      return os.MkdirAll(dst, fi.Mode())
+    }
+
+    action, err := restoreFile(ctx, path, dst, fi, opts)
+    if err != nil {
+      return err
+    }
+    actions = append(actions, action)
+    return nil
+  })
+
+  if err != nil {
+    return actions, fmt.Errorf("Couldn't restore %s in restoreTree(): %w", src, err)
+  }
+  return actions, nil
+}
+
+/* restoreFile() copies src to dst unless dst already holds the same
+file. Files that differ are handled according to the conflict policy */
+func restoreFile(ctx context.Context, src string, dst string, fi os.FileInfo, opts processor.RestoreOptions) (string, error) {
+  di, err := os.Lstat(dst)
+  if err == nil && !fileChanged(fi, di) {
+    return "unchanged "+dst, nil
+  } else if os.IsNotExist(err) {
+    if opts.DryRun {
+      return "create "+dst, nil
+    }
+    return "create "+dst, copyFileWithTimes(ctx, src, dst, fi)
+  } else if err != nil {
+    return "", err
+  }
+
+  switch opts.Policy {
+    case processor.SkipConflicts:
+      return "skip "+dst, nil
+    case processor.KeepBothConflicts:
+      kept := keepBothName(dst)
+      if opts.DryRun {
+        return "keep-both "+dst+" -> "+kept, nil
+      }
+      return "keep-both "+dst+" -> "+kept, copyFileWithTimes(ctx, src, kept, fi)
+  }
+
+  if opts.DryRun {
+    return "overwrite "+dst, nil
+  }
+  return "overwrite "+dst, copyFileWithTimes(ctx, src, dst, fi)
+}
+
+/* keepBothName() finds a free name next to path in the form
+"name (restored).ext", "name (restored 2).ext" and so on */
+func keepBothName(path string) string {
+  ext := filepath.Ext(path)
+  base := strings.TrimSuffix(path, ext)
+  candidate := base+" (restored)"+ext
+  for i := 2; ; i++ {
+    if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+      return candidate
+    }
+    candidate = base+" (restored "+strconv.Itoa(i)+")"+ext
+  }
+}
@@ -0,0 +1,201 @@
+package reflector
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "context"
+  "path/filepath"
+  "io/ioutil"
+  "strings"
+  "sort"
+  "time"
+  "fmt"
+  "os"
+)
+
+const (
+  // No colons so snapshots can live on FAT formatted drives
+  SnapshotTimeFormat string = "2006-01-02T15-04-05"
+  LatestSnapshot = "latest"
+  incompleteSnapshot = ".incomplete"
+)
+
+type Snapshot struct {
+  Name string
+  Time time.Time
+}
+
+type SnapshotReflector struct {
+  originalDirectory string
+  reflectingDirectory string
+  track *tracker
+  updates chan<- processor.BackupProgress
+}
+
+// Satisfies interactor.reflectorCreator
+func NewSnapshotReflector(original, reflecting string) (processor.Reflector, error) {
+  sr := SnapshotReflector{
+    originalDirectory: original,
+    reflectingDirectory: reflecting,
+  }
+  return &sr, nil
+}
+
+/* SnapshotReflector.Backup() creates a new timestamped snapshot of
+the original directory under the reflection. Files that are unchanged
+since the previous snapshot are hard linked against it so every
+snapshot is complete but only changed files take up space. The
+snapshot is built in a hidden directory that is resumed if a backup
+is interrupted and only renamed into place once it is complete */
+func (s *SnapshotReflector) Backup(ctx context.Context) error {
+  s.track = newTracker(s.updates)
+  err := os.MkdirAll(s.reflectingDirectory, 0755)
+  if err != nil {
+    return fmt.Errorf("Couldn't create reflection in SnapshotReflector.Backup(): %v", err)
+  }
+  if err = s.track.scan(ctx, s.originalDirectory); err != nil {
+    return fmt.Errorf("Couldn't scan original in SnapshotReflector.Backup(): %w", err)
+  }
+
+  previous := ""
+  latest, err := FindLatestSnapshot(s.reflectingDirectory)
+  if err == nil {
+    previous = filepath.Join(s.reflectingDirectory, latest.Name)
+  } else if !os.IsNotExist(err) {
+    return fmt.Errorf("Couldn't find previous snapshot in SnapshotReflector.Backup(): %v", err)
+  }
+
+  staging := filepath.Join(s.reflectingDirectory, incompleteSnapshot)
+  err = linkSyncDir(ctx, s.originalDirectory, staging, previous, s.track)
+  if err != nil {
+    return fmt.Errorf("Couldn't build snapshot in SnapshotReflector.Backup(): %w", err)
+  }
+
+  name := newSnapshotName(s.reflectingDirectory, time.Now())
+  snapshot := filepath.Join(s.reflectingDirectory, name)
+  if err = os.Rename(staging, snapshot); err != nil {
+    return fmt.Errorf("Couldn't move snapshot into place in SnapshotReflector.Backup(): %v", err)
+  }
+
+  if err = setLatestSnapshot(s.reflectingDirectory, name); err != nil {
+    return fmt.Errorf("Couldn't update latest snapshot in SnapshotReflector.Backup(): %v", err)
+  }
+  s.track.finish()
+  return nil
+}
+
+// Files hard linked from the previous snapshot are not counted
+func (s SnapshotReflector) Stats() processor.BackupStats {
+  return s.track.counted()
+}
+
+func (s *SnapshotReflector) ReportProgress(c chan<- processor.BackupProgress) {
+  s.updates = c
+}
+
+/* newSnapshotName() names a snapshot taken at now. Names normally
+stop at the second but get fractional seconds when a snapshot was
+already taken that second. Parsing accepts both so they still sort */
+func newSnapshotName(root string, now time.Time) string {
+  name := now.Format(SnapshotTimeFormat)
+  for {
+    if _, err := os.Lstat(filepath.Join(root, name)); os.IsNotExist(err) {
+      return name
+    }
+    name = now.Format(SnapshotTimeFormat+".000000000")
+    now = now.Add(time.Nanosecond)
+  }
+}
+
+/* ListSnapshots() returns every complete snapshot under root
+sorted from oldest to newest */
+func ListSnapshots(root string) ([]Snapshot, error) {
+  entries, err := ioutil.ReadDir(root)
+  if err != nil {
+    return nil, err
+  }
+
+  snapshots := make([]Snapshot, 0)
+  for _, entry := range entries {
+    if !entry.IsDir() {
+      continue
+    }
+    taken, err := time.ParseInLocation(SnapshotTimeFormat, entry.Name(), time.Local)
+    if err != nil {
+      continue
+    }
+    snapshots = append(snapshots, Snapshot{Name: entry.Name(), Time: taken})
+  }
+
+  sort.Slice(snapshots, func(i, j int) bool {
+    return snapshots[i].Time.Before(snapshots[j].Time)
+  })
+  return snapshots, nil
+}
+
+/* FindLatestSnapshot() follows the latest pointer under root and
+falls back to the newest snapshot if the pointer is missing. An
+os.IsNotExist() error is returned when there are no snapshots */
+func FindLatestSnapshot(root string) (Snapshot, error) {
+  name := readLatestSnapshot(root)
+  if name != "" {
+    taken, err := time.ParseInLocation(SnapshotTimeFormat, name, time.Local)
+    if fi, statErr := os.Stat(filepath.Join(root, name)); err == nil && statErr == nil && fi.IsDir() {
+      return Snapshot{Name: name, Time: taken}, nil
+    }
+  }
+
+  snapshots, err := ListSnapshots(root)
+  if err != nil {
+    return Snapshot{}, err
+  }
+  if len(snapshots) == 0 {
+    return Snapshot{}, os.ErrNotExist
+  }
+  return snapshots[len(snapshots) - 1], nil
+}
+
+/* The latest pointer is a relative symlink. Drives that don't
+support symlinks get a plain file holding the snapshot name */
+func setLatestSnapshot(root string, name string) error {
+  latest := filepath.Join(root, LatestSnapshot)
+  tmp := latest+tempSuffix
+  os.Remove(tmp)
+
+  if err := os.Symlink(name, tmp); err != nil {
+    return WriteFileAtomic(latest, []byte(name+"\n"), 0644)
+  }
+  if err := os.Rename(tmp, latest); err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  return syncParent(latest)
+}
+
+func readLatestSnapshot(root string) string {
+  latest := filepath.Join(root, LatestSnapshot)
+  if name, err := os.Readlink(latest); err == nil {
+    return filepath.Base(name)
+  }
+  if data, err := ioutil.ReadFile(latest); err == nil {
+    return strings.TrimSpace(string(data))
+  }
+  return ""
+}
+
+/* linkUnchanged() hard links prev to dst when prev matches the size
+and modification time of the original. It reports false without an
+error when prev has changed or the drive doesn't support hard links */
+func linkUnchanged(prev string, dst string, original os.FileInfo) (bool, error) {
+  pi, err := os.Lstat(prev)
+  if err != nil || fileChanged(original, pi) {
+    return false, nil
+  }
+
+  if err = os.RemoveAll(dst); err != nil {
+    return false, err
+  }
+  if err = os.Link(prev, dst); err != nil {
+    return false, nil
+  }
+  return true, nil
+}
@@ -0,0 +1,120 @@
+package reflector
+
+import (
+  "path/filepath"
+  "io/ioutil"
+  "fmt"
+  "log"
+  "os"
+)
+
+const (
+  stagingSuffix string = ".goback-staging"
+  retiredSuffix = ".goback-old"
+  tempSuffix = ".goback-tmp"
+)
+
+/* Staging and retired directories sit next to the reflection so
+that they are on the same drive and can be swapped with a rename */
+func stagingPath(reflecting string) string {
+  return filepath.Clean(reflecting)+stagingSuffix
+}
+
+func retiredPath(reflecting string) string {
+  return filepath.Clean(reflecting)+retiredSuffix
+}
+
+/* recoverStaging() repairs whatever a previous interrupted swap left
+behind. A retired reflection without a current one is moved back into
+place, otherwise the retired copy is finally deleted. Staging
+directories are left alone so the next backup can resume them */
+func recoverStaging(reflecting string) error {
+  retired := retiredPath(reflecting)
+  if _, err := os.Lstat(retired); os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+
+  if _, err := os.Lstat(reflecting); os.IsNotExist(err) {
+    log.Printf("Restoring interrupted backup of %s from %s", reflecting, retired)
+    if err = os.Rename(retired, reflecting); err != nil {
+      return err
+    }
+    return syncParent(reflecting)
+  } else if err != nil {
+    return err
+  }
+  return os.RemoveAll(retired)
+}
+
+/* swapStaging() atomically replaces reflecting with staging. The old
+reflection is only deleted once the new one is in place */
+func swapStaging(staging string, reflecting string) error {
+  retired := retiredPath(reflecting)
+  _, err := os.Lstat(reflecting)
+  hasOld := err == nil
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+
+  if hasOld {
+    if err = os.Rename(reflecting, retired); err != nil {
+      return fmt.Errorf("Couldn't retire old reflection in swapStaging(): %v", err)
+    }
+  }
+  if err = os.Rename(staging, reflecting); err != nil {
+    if hasOld {
+      os.Rename(retired, reflecting)
+    }
+    return fmt.Errorf("Couldn't move staging into place in swapStaging(): %v", err)
+  }
+  if err = syncParent(reflecting); err != nil {
+    return fmt.Errorf("Couldn't sync parent directory in swapStaging(): %v", err)
+  }
+
+  if hasOld {
+    if err = os.RemoveAll(retired); err != nil {
+      return fmt.Errorf("Couldn't delete retired reflection in swapStaging(): %v", err)
+    }
+  }
+  return nil
+}
+
+/* WriteFileAtomic() is ioutil.WriteFile() through a synced temporary
+file that is renamed over path, after which the directory is synced so
+a crash leaves either the old or the new contents */
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+  out, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*"+tempSuffix)
+  if err != nil {
+    return err
+  }
+  tmp := out.Name()
+  err = out.Chmod(perm)
+  if err == nil {
+    _, err = out.Write(data)
+  }
+  if err == nil {
+    err = out.Sync()
+  }
+  if cerr := out.Close(); err == nil {
+    err = cerr
+  }
+  if err == nil {
+    err = os.Rename(tmp, path)
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  return syncParent(path)
+}
+
+func syncParent(path string) error {
+  dir, err := os.Open(filepath.Dir(path))
+  if err != nil {
+    return err
+  }
+  defer dir.Close()
+  return dir.Sync()
+}
@@ -1,22 +1,28 @@
 package main
 
 import (
+  "github.com/arstevens/goback/daemon/processor"
+  "io/ioutil"
   "strconv"
   "strings"
+  "errors"
   "bufio"
   "fmt"
   "log"
   "net"
   "io"
+  "os"
 )
 
 /* listenAndRelay() connects and communicates with anyone
-on the local port. It will receive all strings and send them
-accross the channel. A response must then come accross the
-channel to be written to the client */
-func ListenAndRelay(port int, ch chan string) {
-  defer close(ch)
-
+on the local port. Every connection is served on its own goroutine
+which reads a single line request, either JSON or a legacy string
+command, and sends it accross the channel as a Call. The response
+comes back on the reply channel of that call and is written to the
+client. Legacy responses may span several lines so the connection
+is closed once the response is written. TCP clients can't be
+identified so their calls carry no peer and are fully trusted */
+func ListenAndRelay(port int, ch chan<- processor.Call) {
   addr := "localhost:"+strconv.Itoa(port)
   ln, err := net.Listen("tcp", addr)
   if err != nil {
@@ -25,35 +31,87 @@ func ListenAndRelay(port int, ch chan string) {
   }
   defer ln.Close()
 
+  serveConnections(ln, ch, func(net.Conn) (*processor.Peer, error) {
+    return nil, nil
+  })
+}
+
+/* ListenUnix() opens a Unix socket at path that every user may
+connect to, replacing whatever socket a previous daemon left there */
+func ListenUnix(path string) (net.Listener, error) {
+  if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+    return nil, fmt.Errorf("Failed to remove stale socket %s in ListenUnix(): %v", path, err)
+  }
+  ln, err := net.Listen("unix", path)
+  if err != nil {
+    return nil, fmt.Errorf("Failed to create listener on %s in ListenUnix(): %v", path, err)
+  }
+  if err = os.Chmod(path, 0666); err != nil {
+    ln.Close()
+    return nil, fmt.Errorf("Failed to open up permissions of %s in ListenUnix(): %v", path, err)
+  }
+  return ln, nil
+}
+
+/* RelayUnix() is the same as ListenAndRelay() but serves a listener
+from ListenUnix(). The credentials of the connecting process are
+attached to each call so the processor can decide what that user
+is allowed to do */
+func RelayUnix(ln net.Listener, ch chan<- processor.Call) {
+  defer ln.Close()
+  serveConnections(ln, ch, peerCredentials)
+}
+
+// serveConnections() returns once ln is closed
+func serveConnections(ln net.Listener, ch chan<- processor.Call, identify func(net.Conn) (*processor.Peer, error)) {
   for {
     conn, err := ln.Accept()
-    if err != nil {
-      log.Printf("Failed to accept connection in listenAndRelay(): %v\n", err)
+    if errors.Is(err, net.ErrClosed) {
+      return
+    } else if err != nil {
+      log.Printf("Failed to accept connection in serveConnections(): %v\n", err)
       continue
     }
     fmt.Println("new connection")
-    err = relayMsgAndResponse(conn, ch)
-    if err != nil {
-      log.Printf("Failed to relay in listenAndRelay(): %v\n", err)
-    }
+    go func(conn net.Conn) {
+      defer conn.Close()
+      peer, err := identify(conn)
+      if err != nil {
+        log.Printf("Failed to identify peer in serveConnections(): %v\n", err)
+        return
+      }
+      if err = relayMsgAndResponse(conn, peer, ch); err != nil {
+        log.Printf("Failed to relay in serveConnections(): %v\n", err)
+      }
+    }(conn)
   }
 }
 
-func relayMsgAndResponse(conn net.Conn, ch chan string) error {
-    msg, err := bufio.NewReader(conn).ReadString('\n')
+/* relayMsgAndResponse() writes every line of the reply until the
+processor closes it. Anything the client sends after its request is
+ignored but the client closing the connection hangs up the call */
+func relayMsgAndResponse(conn net.Conn, peer *processor.Peer, ch chan<- processor.Call) error {
+    reader := bufio.NewReader(conn)
+    msg, err := reader.ReadString('\n')
     if err != nil && err != io.EOF {
       return fmt.Errorf("Failed to read msg from client in relayMsgAndResponse(): %v\n", err)
     }
     fmt.Printf("Message received: %s\n", msg)
     msg = strings.Trim(msg, "\n")
 
-    // Process message and send response back
-    ch<-msg
-    resp := <-ch
-    fmt.Printf("Message response: %s\n", resp)
-    resp += "\n"
-    if _, err = conn.Write([]byte(resp)); err != nil {
-      return fmt.Errorf("Failed to write msg to client in relayMsgAndResponse(): %v\n", err)
+    // Process message and wait for the response to this call
+    call := processor.NewCall(msg, peer)
+    go func() {
+      io.Copy(ioutil.Discard, reader)
+      close(call.Hangup)
+    }()
+    ch<-call
+    for resp := range call.Reply {
+      fmt.Printf("Message response: %s\n", resp)
+      resp += "\n"
+      if _, err = conn.Write([]byte(resp)); err != nil {
+        return fmt.Errorf("Failed to write msg to client in relayMsgAndResponse(): %v\n", err)
+      }
     }
     return nil
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+  "github.com/arstevens/goback/daemon/processor"
+  "path/filepath"
+  "io/ioutil"
+  "strconv"
+  "strings"
+  "testing"
+  "bufio"
+  "sync"
+  "time"
+  "net"
+  "os"
+)
+
+/* relayTestServer() serves unidentified clients on a free port until
+the test ends and returns the address to connect to */
+func relayTestServer(t *testing.T, ch chan<- processor.Call) string {
+  ln, err := net.Listen("tcp", "localhost:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    ln.Close()
+  })
+  go serveConnections(ln, ch, func(net.Conn) (*processor.Peer, error) {
+    return nil, nil
+  })
+  return ln.Addr().String()
+}
+
+func TestListenAndRelayConcurrent(t *testing.T) {
+  ch := make(chan processor.Call)
+  addr := relayTestServer(t, ch)
+
+  // Echo every message back, answering out of order
+  go func() {
+    for call := range ch {
+      go func(call processor.Call) {
+        if call.Message == "slow" {
+          time.Sleep(200 * time.Millisecond)
+        }
+        call.Reply<-"echo "+call.Message
+        close(call.Reply)
+      }(call)
+    }
+  }()
+
+  conn, err := net.Dial("tcp", addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // A client that never finishes its request must not block anyone
+  defer conn.Close()
+
+  var wg sync.WaitGroup
+  for i := 0; i < 10; i++ {
+    msg := strconv.Itoa(i)
+    if i == 0 {
+      msg = "slow"
+    }
+    wg.Add(1)
+    go func(msg string) {
+      defer wg.Done()
+      resp, err := sendTestMessage(addr, msg)
+      if err != nil {
+        t.Errorf("Failed to send %s: %v", msg, err)
+      } else if resp != "echo "+msg {
+        t.Errorf("Expected response to %s but got %q", msg, resp)
+      }
+    }(msg)
+  }
+
+  done := make(chan struct{})
+  go func() {
+    wg.Wait()
+    close(done)
+  }()
+  select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+      t.Fatal("Clients were blocked by each other")
+  }
+}
+
+func sendTestMessage(addr string, msg string) (string, error) {
+  conn, err := net.Dial("tcp", addr)
+  if err != nil {
+    return "", err
+  }
+  defer conn.Close()
+  if _, err = conn.Write([]byte(msg+"\n")); err != nil {
+    return "", err
+  }
+  resp, err := bufio.NewReader(conn).ReadString('\n')
+  return strings.TrimSpace(resp), err
+}
+
+func TestRelayUnix(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  socket := filepath.Join(tmp, "goback.sock")
+  ch := make(chan processor.Call)
+  ln, err := ListenUnix(socket)
+  if err != nil {
+    t.Fatal(err)
+  }
+  go RelayUnix(ln, ch)
+  defer ln.Close()
+
+  peers := make(chan *processor.Peer, 1)
+  go func() {
+    call := <-ch
+    peers<-call.Peer
+    call.Reply<-"ok"
+    close(call.Reply)
+  }()
+
+  var conn net.Conn
+  for i := 0; i < 50; i++ {
+    if conn, err = net.Dial("unix", socket); err == nil {
+      break
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  if _, err = conn.Write([]byte("hello\n")); err != nil {
+    t.Fatal(err)
+  }
+  resp, err := bufio.NewReader(conn).ReadString('\n')
+  if err != nil || strings.TrimSpace(resp) != "ok" {
+    t.Fatalf("Expected ok but got %q: %v", resp, err)
+  }
+
+  peer := <-peers
+  if peer == nil || int(peer.UID) != os.Getuid() || int(peer.PID) != os.Getpid() {
+    t.Errorf("Expected credentials of this process but got %+v", peer)
+  }
+  if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0666 {
+    t.Errorf("Expected socket to be usable by everyone: %v", err)
+  }
+}
+
+func TestListenUnixFailure(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "goback")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  if ln, err := ListenUnix(filepath.Join(tmp, "missing", "goback.sock")); err == nil {
+    ln.Close()
+    t.Errorf("Expected listening in a missing directory to fail")
+  }
+}
+
+func TestRelayStream(t *testing.T) {
+  ch := make(chan processor.Call)
+  addr := relayTestServer(t, ch)
+
+  // Keep answering until the client hangs up
+  hungUp := make(chan struct{})
+  go func() {
+    call := <-ch
+    defer close(call.Reply)
+    for i := 0; ; i++ {
+      select {
+        case call.Reply<-strconv.Itoa(i):
+        case <-call.Hangup:
+          close(hungUp)
+          return
+      }
+    }
+  }()
+
+  conn, err := net.Dial("tcp", addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = conn.Write([]byte("sub\n")); err != nil {
+    t.Fatal(err)
+  }
+  reader := bufio.NewReader(conn)
+  for i := 0; i < 3; i++ {
+    line, err := reader.ReadString('\n')
+    if err != nil || strings.TrimSpace(line) != strconv.Itoa(i) {
+      t.Fatalf("Expected line %d but got %q: %v", i, line, err)
+    }
+  }
+
+  conn.Close()
+  select {
+    case <-hungUp:
+    case <-time.After(5 * time.Second):
+      t.Fatal("Closing the connection didn't hang up the call")
+  }
+}